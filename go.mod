@@ -3,12 +3,15 @@ module github.com/bep/npmgoproxy
 go 1.17
 
 require (
-	github.com/frankban/quicktest v1.13.1 // indirect
+	github.com/frankban/quicktest v1.13.1
+	golang.org/x/mod v0.5.0
+)
+
+require (
 	github.com/google/go-cmp v0.5.6 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/mitchellh/mapstructure v1.4.2 // indirect
 	github.com/rogpeppe/go-internal v1.6.1 // indirect
-	golang.org/x/mod v0.5.0 // indirect
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 )
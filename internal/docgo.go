@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"archive/tar"
+	"fmt"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// docGoName is the name of the file added to the module root,
+// see ClientOptions.DocGo.
+const docGoName = "doc.go"
+
+// docGo returns the doc.go for version, a Go package with a package
+// comment naming the npm package, so the module has something to show in
+// go doc and module viewers.
+func docGo(version Version) []byte {
+	name := goPackageName(version.Name)
+	return []byte(fmt.Sprintf(`// Package %s is the npm package %s %s repacked as a Go module.
+//
+// It contains no Go code, the npm package files are in the package directory.
+package %s
+`, name, version.Name, strings.TrimPrefix(version.Version, "v"), name))
+}
+
+// docGoFile returns the doc.go for version as a file for zip.Create.
+func docGoFile(version Version) memFile {
+	b := docGo(version)
+	return memFile{
+		header: &tar.Header{Name: docGoName, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(b))},
+		b:      b,
+	}
+}
+
+// goPackageName returns a valid Go package name for the npm package
+// npmName, e.g. reactivity for @vue/reactivity and lodashmerge for lodash.merge.
+func goPackageName(npmName string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(path.Base(npmName)) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	name := b.String()
+	if name == "" || name[0] >= '0' && name[0] <= '9' || token.IsKeyword(name) {
+		name = "npm" + name
+	}
+	return name
+}
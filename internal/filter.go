@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CheckFilePatterns checks the patterns in ClientOptions.IncludeFiles
+// and ClientOptions.ExcludeFiles.
+func CheckFilePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// keepEntry reports whether the tarball entry name, below package/,
+// goes into the module zip, see ClientOptions.IncludeFiles and
+// ClientOptions.ExcludeFiles. The package.json is always kept.
+func (c *Client) keepEntry(name string, isDir bool) bool {
+	rel := strings.Trim(strings.TrimPrefix(name, "package"), "/")
+	if rel == "" || rel == "package.json" {
+		return true
+	}
+	for _, pattern := range c.opts.ExcludeFiles {
+		if matchFile(pattern, rel) {
+			return false
+		}
+	}
+	if len(c.opts.IncludeFiles) == 0 || isDir {
+		return true
+	}
+	for _, pattern := range c.opts.IncludeFiles {
+		if matchFile(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFile reports whether the package file or directory rel matches pattern.
+// Patterns with a slash, e.g. test/fixtures or /dist/*.map, match from the
+// package root, others, e.g. *.map, match a name at any depth.
+// A pattern matching a directory matches everything below it.
+func matchFile(pattern, rel string) bool {
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.Trim(pattern, "/")
+	elems := strings.Split(rel, "/")
+	for i, elem := range elems {
+		name := elem
+		if anchored {
+			name = strings.Join(elems[:i+1], "/")
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
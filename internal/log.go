@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// RequestIDHeader is the header request IDs are read from and
+// propagated to the registry in.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// DefaultLogger returns the logger used when none is configured,
+// which writes plain lines to stdout.
+func DefaultLogger() *log.Logger {
+	return log.New(os.Stdout, "", 0)
+}
+
+// Logf logs to l, prefixed with the request ID carried by ctx, if any.
+func Logf(ctx context.Context, l *log.Logger, format string, args ...interface{}) {
+	if id := RequestID(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	l.Printf(format, args...)
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
+)
+
+// spillBuffer buffers writes in memory up to threshold bytes,
+// then moves them to the file returned by create and writes there.
+type spillBuffer struct {
+	threshold int64
+	create    func() (*os.File, error)
+
+	buf bytes.Buffer
+	f   *os.File
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && int64(b.buf.Len()+len(p)) <= b.threshold {
+		return b.buf.Write(p)
+	}
+	if b.f == nil {
+		f, err := b.create()
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+		if _, err := f.Write(b.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		b.buf = bytes.Buffer{}
+	}
+	return b.f.Write(p)
+}
+
+// repackTarballInMemory is repackTarballAsZip for a tarball in memory,
+// without any disk IO.
+func (c *Client) repackTarballInMemory(ctx context.Context, tarball []byte, version Version) (nameReadSeekCloser, error) {
+	var (
+		files []zip.File
+		index = make(map[string]int)
+		size  int64
+	)
+	err := c.readTarball(ctx, bytes.NewReader(tarball), func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg || skipInMemory(header.Name) {
+			return nil
+		}
+		// Guard against tarballs inflating to more than a module zip can hold.
+		b, err := io.ReadAll(io.LimitReader(r, zip.MaxZipFile-size+1))
+		if err != nil {
+			return err
+		}
+		size += int64(len(b))
+		if size > zip.MaxZipFile {
+			return invalidModuleError{fmt.Errorf("package is too large for a Go module: exceeds %d bytes", zip.MaxZipFile)}
+		}
+		f := memFile{header: header, b: b}
+		if i, found := index[header.Name]; found {
+			// Later entries overwrite earlier ones, as on disk.
+			files[i] = f
+			return nil
+		}
+		index[header.Name] = len(files)
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to untar: %w", err)
+	}
+
+	// Sort the files as CreateFromDir walks them, so the zips are
+	// identical to the ones repacked on disk.
+	sort.Slice(files, func(i, j int) bool {
+		return walkLess(files[i].Path(), files[j].Path())
+	})
+
+	cf, err := zip.CheckFiles(files)
+	if err := checkedFilesError(cf, err, func(p string) string { return p }); err != nil {
+		return nil, invalidModuleError{err}
+	}
+	if c.opts.RequireSource {
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = f.Path()
+		}
+		if err := checkSourceFiles(paths); err != nil {
+			return nil, invalidModuleError{fmt.Errorf("%s@%s: %w", version.Name, version.Version, err)}
+		}
+	}
+	if _, found := index[docGoName]; c.opts.DocGo && !found {
+		files = append(files, docGoFile(version))
+		sort.Slice(files, func(i, j int) bool {
+			return walkLess(files[i].Path(), files[j].Path())
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := zip.Create(&buf, module.Version{Path: VersionModulePath(c.opts.ModulePathBase, version.Name, version.Version), Version: version.Version}, files); err != nil {
+		return nil, invalidModuleError{err}
+	}
+
+	return memZip{Reader: bytes.NewReader(buf.Bytes()), name: fileName(version.Name) + ".zip"}, nil
+}
+
+// skipInMemory reports whether the file p is left out of the zip,
+// as CreateFromDir does for files in VCS directories.
+func skipInMemory(p string) bool {
+	for _, elem := range strings.Split(path.Dir(p), "/") {
+		switch elem {
+		case ".bzr", ".git", ".hg", ".svn":
+			return true
+		}
+	}
+	return false
+}
+
+// walkLess reports whether the slash separated path a comes before b
+// in the lexical order filepath.Walk visits files in.
+func walkLess(a, b string) bool {
+	ae, be := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ae) && i < len(be); i++ {
+		if ae[i] != be[i] {
+			return ae[i] < be[i]
+		}
+	}
+	return len(ae) < len(be)
+}
+
+// memFile is a file read from a tarball into memory.
+type memFile struct {
+	header *tar.Header
+	b      []byte
+}
+
+func (f memFile) Path() string                 { return f.header.Name }
+func (f memFile) Lstat() (os.FileInfo, error)  { return f.header.FileInfo(), nil }
+func (f memFile) Open() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(f.b)), nil }
+
+// memZip is a module zip, or a tarball, in memory.
+type memZip struct {
+	*bytes.Reader
+	name string
+}
+
+func (z memZip) Name() string { return z.name }
+func (z memZip) Close() error { return nil }
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storedPackage is a package document stored in ClientOptions.MetadataCacheDir.
+type storedPackage struct {
+	// Fetched is when the document was fetched from the registry.
+	Fetched time.Time
+
+	// Document is the package document as served by the registry.
+	Document json.RawMessage
+}
+
+// packageDocumentFilename returns the file the package document of pkg
+// is stored in, see ClientOptions.MetadataCacheDir.
+func (c *Client) packageDocumentFilename(pkg string) string {
+	return filepath.Join(c.opts.MetadataCacheDir, fileName(pkg)+".json")
+}
+
+// loadPackageDocument loads the stored package document of pkg and returns
+// it with the time it was fetched, failing with ErrPackageNotFound if there
+// is none. Corrupt files, e.g. truncated, fail to decode.
+func (c *Client) loadPackageDocument(pkg string) (NpmPackage, time.Time, error) {
+	filename := c.packageDocumentFilename(pkg)
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NpmPackage{}, time.Time{}, fmt.Errorf("package %q: %w", pkg, ErrPackageNotFound)
+		}
+		return NpmPackage{}, time.Time{}, err
+	}
+	var sp storedPackage
+	if err := json.Unmarshal(b, &sp); err != nil || sp.Fetched.IsZero() || len(sp.Document) == 0 {
+		if err == nil {
+			err = errors.New("missing fetch time or document")
+		}
+		return NpmPackage{}, time.Time{}, fmt.Errorf("failed to decode %s: %w", filename, err)
+	}
+	npmp, err := c.decodePackageDocument(pkg, sp.Document)
+	if err != nil {
+		return NpmPackage{}, time.Time{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return npmp, sp.Fetched, nil
+}
+
+// storePackageDocument stores the package document b of pkg, fetched
+// at fetched, if enabled. It's written to a temp file renamed into place,
+// so concurrent readers see either the complete document or the previous one.
+func (c *Client) storePackageDocument(pkg string, b []byte, fetched time.Time) error {
+	if c.opts.MetadataCacheDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(storedPackage{Fetched: fetched, Document: b})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.opts.MetadataCacheDir, 0o755); err != nil {
+		return err
+	}
+	filename := c.packageDocumentFilename(pkg)
+	f, err := os.CreateTemp(c.opts.MetadataCacheDir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
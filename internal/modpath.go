@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// ModulePath returns the Go module path below base, e.g. ModPathBase, for the
+// npm package pkg with the major version suffix major, e.g.
+// gohugo.io/npmjs/___vue/reactivity/v3.
+// This is the unescaped path used in go.mod files and module zips; see
+// module.EscapePath for the form used in GOPROXY URLs and on disk.
+func ModulePath(base, pkg, major string) string {
+	return path.Join(base, EscapePackage(pkg), major)
+}
+
+// VersionModulePath returns the Go module path below base for version v of
+// the npm package pkg, with the major version suffix derived from v,
+// e.g. gohugo.io/npmjs/___vue/reactivity/v3 for @vue/reactivity v3.4.0.
+func VersionModulePath(base, pkg, v string) string {
+	return ModulePath(base, pkg, PathMajor(v))
+}
+
+// ParseModulePath parses an unescaped Go module path below base,
+// e.g. gohugo.io/npmjs/___vue/reactivity/v3, into the npm package name
+// unescaped using e and the major version suffix without the slash, e.g. v3.
+// The major version is empty for v0 and v1 modules.
+func ParseModulePath(base, p string, e PathEscaping) (pkg string, major string, err error) {
+	if !strings.HasPrefix(p, base+"/") {
+		return "", "", fmt.Errorf("module path %q is not below %s", p, base)
+	}
+
+	prefix, pathMajor, ok := module.SplitPathVersion(p)
+	if !ok {
+		return "", "", fmt.Errorf("invalid module path %q", p)
+	}
+
+	// The major version suffix may directly follow the base, e.g. gohugo.io/npmjs/v2.
+	pkg = strings.TrimPrefix(prefix, base+"/")
+	if pkg == "" || pkg == prefix {
+		return "", "", fmt.Errorf("module path %q has no npm package", p)
+	}
+
+	pkg, err = e.Unescape(pkg)
+	if err != nil {
+		return "", "", fmt.Errorf("module path %q: %w", p, err)
+	}
+
+	return pkg, strings.TrimPrefix(pathMajor, "/"), nil
+}
+
+// maxPackageNameLength is the maximum length of npm package names, scope included.
+const maxPackageNameLength = 214
+
+// CheckPackageName checks that pkg is a valid npm package name, e.g. one
+// that doesn't start with a dot or an underscore, so requests for names
+// the registry can't have are rejected without asking it. Names with
+// uppercase letters are valid, as npm still serves the packages published
+// before they were disallowed, e.g. JSONStream, so they're not lowercased.
+// The mistyped ones, e.g. Vue, fail with ErrUppercasePackageName instead.
+func CheckPackageName(pkg string) error {
+	scope, name := "", pkg
+	if strings.HasPrefix(pkg, "@") {
+		i := strings.Index(pkg, "/")
+		if i == -1 {
+			return fmt.Errorf("invalid npm package name %q: a scope without a name", pkg)
+		}
+		scope, name = pkg[1:i], pkg[i+1:]
+		if scope == "" {
+			return fmt.Errorf("invalid npm package name %q: empty scope", pkg)
+		}
+	}
+	switch {
+	case name == "":
+		return fmt.Errorf("invalid npm package name %q: empty name", pkg)
+	case len(pkg) > maxPackageNameLength:
+		return fmt.Errorf("invalid npm package name %q: longer than %d characters", pkg, maxPackageNameLength)
+	case scope == "" && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")):
+		return fmt.Errorf("invalid npm package name %q: leading %q", pkg, name[:1])
+	case strings.HasSuffix(name, "."):
+		return fmt.Errorf("invalid npm package name %q: trailing dot", pkg)
+	case scope == "" && (strings.EqualFold(name, "node_modules") || strings.EqualFold(name, "favicon.ico")):
+		return fmt.Errorf("invalid npm package name %q: reserved", pkg)
+	}
+	for _, r := range scope + name {
+		if !isPackageNameChar(r) {
+			return fmt.Errorf("invalid npm package name %q: invalid character %q", pkg, r)
+		}
+	}
+	return nil
+}
+
+// isPackageNameChar reports whether r may be used in npm package names,
+// which are URL-safe: unreserved characters and the legacy !'()*.
+func isPackageNameChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("-._~!'()*", r)
+}
+
+// scopePrefix replaces the @ starting scoped npm package names in module paths.
+const scopePrefix = "___"
+
+// PathEscaping is the scheme used to escape npm package names
+// in Go module paths, which can't contain @.
+type PathEscaping int
+
+const (
+	// EscapeScope escapes the @ starting scoped package names as ___,
+	// e.g. ___vue/reactivity for @vue/reactivity, and keeps the rest of
+	// the name, underscores included. npm package names can't start with
+	// an underscore and only scoped names have a slash, which makes the
+	// escaping reversible and collision-free.
+	EscapeScope PathEscaping = iota
+
+	// EscapeLegacy unescapes every ___ in module paths as @, as done before
+	// EscapeScope, which e.g. maps foo___bar to foo@bar. The escaped module
+	// paths are the same as with EscapeScope.
+	EscapeLegacy
+)
+
+func (e PathEscaping) String() string {
+	switch e {
+	case EscapeScope:
+		return "scope"
+	case EscapeLegacy:
+		return "legacy"
+	}
+	return fmt.Sprintf("PathEscaping(%d)", int(e))
+}
+
+// EscapePackage escapes the npm package name pkg for use in
+// Go module paths, e.g. ___vue/reactivity for @vue/reactivity.
+func EscapePackage(pkg string) string {
+	if strings.HasPrefix(pkg, "@") {
+		return scopePrefix + pkg[1:]
+	}
+	return pkg
+}
+
+// Unescape returns the npm package name escaped as p in a module path.
+func (e PathEscaping) Unescape(p string) (string, error) {
+	if e == EscapeLegacy {
+		return strings.ReplaceAll(p, scopePrefix, "@"), nil
+	}
+	if strings.Contains(p, "@") {
+		return "", fmt.Errorf("invalid npm package name %q: unescaped @", p)
+	}
+	name := strings.TrimPrefix(p, scopePrefix)
+	if name == p {
+		// Only scoped package names have a slash.
+		if strings.Contains(p, "/") {
+			return "", fmt.Errorf("invalid npm package name %q: a slash without a scope", p)
+		}
+		return p, nil
+	}
+	i := strings.Index(name, "/")
+	if i <= 0 || i == len(name)-1 || strings.Contains(name[i+1:], "/") {
+		return "", fmt.Errorf("invalid npm package name %q: expected ___scope/name", p)
+	}
+	return "@" + name, nil
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/mod/module"
+)
+
+func TestParseModulePath(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		path  string
+		pkg   string
+		major string
+	}{
+		{"gohugo.io/npmjs/alpinejs", "alpinejs", ""},
+		{"gohugo.io/npmjs/alpinejs/v3", "alpinejs", "v3"},
+		{"gohugo.io/npmjs/___vue/reactivity/v3", "@vue/reactivity", "v3"},
+		{"gohugo.io/npmjs/___vue/reactivity", "@vue/reactivity", ""},
+	} {
+		pkg, major, err := ParseModulePath(ModPathBase, test.path, EscapeScope)
+		c.Assert(err, qt.IsNil)
+		c.Assert(pkg, qt.Equals, test.pkg)
+		c.Assert(major, qt.Equals, test.major)
+	}
+
+	pkg, major, err := ParseModulePath("npm.example.org", "npm.example.org/___vue/reactivity/v3", EscapeScope)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pkg, qt.Equals, "@vue/reactivity")
+	c.Assert(major, qt.Equals, "v3")
+	_, _, err = ParseModulePath("npm.example.org", "npm.example.org/v3", EscapeScope)
+	c.Assert(err, qt.ErrorMatches, `module path "npm.example.org/v3" has no npm package`)
+
+	for _, path := range []string{
+		"example.org/alpinejs",
+		"gohugo.io/npmjs",
+		"gohugo.io/npmjs/",
+		"gohugo.io/npmjs/alpinejs/v1",
+		"gohugo.io/npmjsfoo/alpinejs",
+		"gohugo.io/npmjs/foo/bar",
+		"gohugo.io/npmjs/___vue",
+		"gohugo.io/npmjs/v2",
+	} {
+		_, _, err := ParseModulePath(ModPathBase, path, EscapeScope)
+		c.Assert(err, qt.IsNotNil, qt.Commentf(path))
+	}
+}
+
+func TestModulePathEscaping(t *testing.T) {
+	c := qt.New(t)
+
+	// Module paths in go.mod files and zips keep the uppercase letters,
+	// only the GOPROXY request paths are bang-encoded.
+	p := ModulePath(ModPathBase, "@Scope/JSONStream", "v2")
+	c.Assert(p, qt.Equals, "gohugo.io/npmjs/___Scope/JSONStream/v2")
+
+	escaped, err := module.EscapePath(p)
+	c.Assert(err, qt.IsNil)
+	c.Assert(escaped, qt.Equals, "gohugo.io/npmjs/___!scope/!j!s!o!n!stream/v2")
+
+	unescaped, err := module.UnescapePath(escaped)
+	c.Assert(err, qt.IsNil)
+	pkg, major, err := ParseModulePath(ModPathBase, unescaped, EscapeScope)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pkg, qt.Equals, "@Scope/JSONStream")
+	c.Assert(major, qt.Equals, "v2")
+}
+
+func TestPathEscaping(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		pkg     string
+		escaped string
+	}{
+		{"alpinejs", "alpinejs"},
+		{"@vue/reactivity", "___vue/reactivity"},
+		{"lodash_merge", "lodash_merge"},
+		{"foo___bar", "foo___bar"},
+		{"foo___", "foo___"},
+		{"@my_scope/foo_bar", "___my_scope/foo_bar"},
+		{"@scope/___foo", "___scope/___foo"},
+		{"@scope___x/foo___bar", "___scope___x/foo___bar"},
+		{"@_/foo", "____/foo"},
+	} {
+		escaped := EscapePackage(test.pkg)
+		c.Assert(escaped, qt.Equals, test.escaped)
+		c.Assert(module.CheckImportPath(ModulePath(ModPathBase, test.pkg, "v2")), qt.IsNil)
+
+		pkg, err := EscapeScope.Unescape(escaped)
+		c.Assert(err, qt.IsNil)
+		c.Assert(pkg, qt.Equals, test.pkg)
+
+		p := VersionModulePath(ModPathBase, test.pkg, "v2.0.0")
+		pkg, major, err := ParseModulePath(ModPathBase, p, EscapeScope)
+		c.Assert(err, qt.IsNil)
+		c.Assert(pkg, qt.Equals, test.pkg)
+		c.Assert(major, qt.Equals, "v2")
+	}
+
+	for _, p := range []string{"a@b", "foo/bar", "___foo", "___/foo", "___foo/", "___foo/bar/baz"} {
+		_, err := EscapeScope.Unescape(p)
+		c.Assert(err, qt.IsNotNil, qt.Commentf(p))
+	}
+
+	// The old scheme unescapes any ___.
+	pkg, err := EscapeLegacy.Unescape("foo___bar")
+	c.Assert(err, qt.IsNil)
+	c.Assert(pkg, qt.Equals, "foo@bar")
+	pkg, err = EscapeLegacy.Unescape("___vue/reactivity")
+	c.Assert(err, qt.IsNil)
+	c.Assert(pkg, qt.Equals, "@vue/reactivity")
+}
+
+func TestCheckPackageName(t *testing.T) {
+	c := qt.New(t)
+
+	for _, pkg := range []string{"alpinejs", "@vue/reactivity", "JSONStream", "@MyScope/Foo", "lodash.merge", "@scope/.foo", "@_/foo", "foo_", "(legacy)!", strings.Repeat("a", 214)} {
+		c.Assert(CheckPackageName(pkg), qt.IsNil, qt.Commentf(pkg))
+	}
+
+	for pkg, want := range map[string]string{
+		"":                       "empty name",
+		"@scope":                 "a scope without a name",
+		"@/foo":                  "empty scope",
+		"@scope/":                "empty name",
+		".foo":                   `leading "."`,
+		"_foo":                   `leading "_"`,
+		"foo.":                   "trailing dot",
+		"@scope/foo.":            "trailing dot",
+		"node_modules":           "reserved",
+		"foo bar":                `invalid character ' '`,
+		"@scope/foo:bar":         `invalid character ':'`,
+		"føø":                    `invalid character 'ø'`,
+		strings.Repeat("a", 215): "longer than 214 characters",
+	} {
+		err := CheckPackageName(pkg)
+		c.Assert(err, qt.ErrorMatches, `invalid npm package name ".*": `+regexp.QuoteMeta(want), qt.Commentf(pkg))
+	}
+}
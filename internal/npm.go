@@ -2,20 +2,28 @@ package internal
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/mod/module"
@@ -25,58 +33,1164 @@ import (
 
 const (
 	ModPathBase = "gohugo.io/npmjs"
+
+	// DefaultRegistry is the npm registry used when none is configured.
+	DefaultRegistry = "https://registry.npmjs.org"
+
+	// DefaultMaxConcurrentRequests is the default limit of concurrent registry requests.
+	DefaultMaxConcurrentRequests = 16
+
+	// DefaultMaxTarballSize is the default limit of tarball downloads, 128 MB.
+	DefaultMaxTarballSize = 128 << 20
+
+	// DefaultMaxPathLength is the default limit of the length of tarball entry paths.
+	DefaultMaxPathLength = 1024
+
+	// DefaultMaxPathDepth is the default limit of the directory nesting of tarball entries.
+	DefaultMaxPathDepth = 64
+
+	// DefaultMetadataTimeout is the default time limit of package and version document requests.
+	DefaultMetadataTimeout = 30 * time.Second
+
+	// DefaultTarballTimeout is the default time limit of tarball downloads.
+	DefaultTarballTimeout = 5 * time.Minute
+)
+
+var (
+	// ErrVersionUnpublished is returned for versions that have been unpublished from the registry.
+	ErrVersionUnpublished = errors.New("version has been unpublished")
+
+	// ErrPackageNotFound is returned for packages the registry doesn't know about.
+	ErrPackageNotFound = errors.New("package not found")
+
+	// ErrUppercasePackageName wraps ErrPackageNotFound for packages with
+	// uppercase letters in their names the registry doesn't know about,
+	// likely mistyped, as only packages published long ago may have them.
+	ErrUppercasePackageName = fmt.Errorf("%w: npm package names are lowercase", ErrPackageNotFound)
+
+	// ErrVersionNotFound is returned for versions the registry doesn't know about.
+	ErrVersionNotFound = errors.New("version not found")
+
+	// ErrTarballTooLarge is returned for tarballs larger than ClientOptions.MaxTarballSize.
+	ErrTarballTooLarge = errors.New("tarball too large")
+
+	// ErrNoSource is returned for packages with nothing but package metadata,
+	// see ClientOptions.RequireSource.
+	ErrNoSource = errors.New("package contains no files besides package.json, README and LICENSE, it may be a placeholder")
+
+	// ErrInvalidModule is wrapped by the errors for packages that can't be
+	// repacked as valid Go modules, e.g. because of invalid file names.
+	ErrInvalidModule = errors.New("invalid Go module")
+
+	// ErrRegistryUnavailable is returned when the registry can't be reached
+	// or fails with a server error.
+	ErrRegistryUnavailable = errors.New("upstream registry unavailable")
+
+	// ErrRegistryUnauthorized is returned when the registry responds with
+	// 401 Unauthorized or 403 Forbidden, e.g. for private packages without
+	// a valid auth token.
+	ErrRegistryUnauthorized = errors.New("upstream registry denied access, check the auth token")
+
+	// ErrShasumMismatch is returned for tarballs not matching the shasum in the registry's dist metadata.
+	ErrShasumMismatch = errors.New("shasum mismatch")
+
+	// ErrIntegrityMismatch is returned for tarballs not matching the integrity hash in the registry's dist metadata.
+	ErrIntegrityMismatch = errors.New("integrity mismatch")
+
+	// ErrOffline is returned for anything that would need a request to the
+	// registry or a tarball host, see ClientOptions.Offline.
+	ErrOffline = errors.New("not available offline")
+
+	// ErrMissingChecksum is returned for tarballs that can't be verified,
+	// as the registry's dist metadata has no checksum required by the Verification policy.
+	ErrMissingChecksum = errors.New("missing checksum")
 )
 
-func FetchPackage(s string) (NpmPackage, error) {
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// Registry is the base URL of the npm registry.
+	// Defaults to DefaultRegistry.
+	Registry string
+
+	// FallbackRegistries are tried in order when Registry, or the
+	// fallback before, can't be reached or fails with a server error.
+	// A 404 is a valid answer and is not retried.
+	FallbackRegistries []string
+
+	// ModulePathBase is the module path the Go modules are below,
+	// e.g. npm.example.org. Defaults to ModPathBase.
+	ModulePathBase string
+
+	// RegistryOverrides fetches the packages with names matching one of the
+	// prefixes from another registry than Registry, e.g. @mycorp/ from a
+	// private one. The longest matching prefix wins. The fallback registries
+	// are not tried for these packages.
+	RegistryOverrides []RegistryOverride
+
+	// URLHosts are the hosts, e.g. github.com, that packages given as
+	// tarball or git URLs may be fetched from with CreateZipFromURLPackage,
+	// also when redirected. Only https is supported. Empty disables URL packages.
+	URLHosts []string
+
+	// MetadataTTL is how long fetched package documents are kept in memory.
+	// Zero disables the metadata cache.
+	MetadataTTL time.Duration
+
+	// MetadataTTLJitter spreads the expiry of each cached document randomly
+	// by up to this fraction of MetadataTTL either way, e.g. 0.1 for ±10%,
+	// so documents cached together don't all expire at once.
+	MetadataTTLJitter float64
+
+	// MetadataStaleWhileRevalidate is how long package documents are still
+	// served after MetadataTTL, while they're refreshed in the background.
+	MetadataStaleWhileRevalidate time.Duration
+
+	// MetadataCacheDir, if set, is the directory the package documents
+	// fetched from the registry are stored in, with the time fetched, so
+	// they survive restarts: they're loaded from there while younger than
+	// MetadataTTL, or always with Offline. Versions are then always looked
+	// up in the full package documents instead of fetched from the
+	// per-version endpoint.
+	MetadataCacheDir string
+
+	// Offline serves the package documents only from MetadataCacheDir and
+	// never sends any requests, failing with ErrPackageNotFound for the
+	// packages not in it and ErrOffline for everything else, e.g. tarballs.
+	Offline bool
+
+	// MetadataTimeout limits the time to fetch a package or version document,
+	// including reading it. Defaults to DefaultMetadataTimeout.
+	MetadataTimeout time.Duration
+
+	// TarballTimeout limits the time to download a tarball.
+	// Defaults to DefaultTarballTimeout.
+	TarballTimeout time.Duration
+
+	// Verification is the policy used to verify downloaded tarballs.
+	Verification Verification
+
+	// CaseCollisions decides what to do with tarball entries
+	// whose paths differ only in case.
+	CaseCollisions CaseCollisionPolicy
+
+	// MaxConcurrentRequests limits the number of concurrent requests to the
+	// registry, including tarball downloads. Requests above the limit wait for
+	// a free slot. Defaults to DefaultMaxConcurrentRequests.
+	MaxConcurrentRequests int
+
+	// MaxTarballSize is the maximum size in bytes of a tarball download.
+	// Defaults to DefaultMaxTarballSize.
+	MaxTarballSize int64
+
+	// MaxPathLength and MaxPathDepth limit the length in bytes and the number
+	// of path elements of the tarball entry paths. Tarballs exceeding them
+	// are rejected. Default to DefaultMaxPathLength and DefaultMaxPathDepth.
+	MaxPathLength int
+	MaxPathDepth  int
+
+	// MaxInMemorySize is the size in bytes up to which tarballs are
+	// downloaded and repacked in memory, avoiding disk IO for small
+	// packages. Larger tarballs spill to disk. Zero always uses disk.
+	MaxInMemorySize int64
+
+	// WorkDir is where tarballs are downloaded and repacked as module
+	// zips, in temporary directories removed when done with the zips.
+	// Defaults to the OS temp dir.
+	WorkDir string
+
+	// RequireSource rejects packages without any files besides
+	// package metadata and docs such as package.json and README.md,
+	// at any depth.
+	RequireSource bool
+
+	// DocGo adds a doc.go with a package comment naming the npm package
+	// to the root of the module zips, making the module a Go package.
+	DocGo bool
+
+	// IncludeFiles, if set, limits the package files in the module zips to
+	// the ones matching one of the patterns, in path.Match syntax. Patterns
+	// with a slash, e.g. dist/*.js, match from the package root, others,
+	// e.g. *.css, match a name at any depth. A pattern matching a directory
+	// matches the files below it. The package.json is always included.
+	IncludeFiles []string
+
+	// ExcludeFiles are patterns, as in IncludeFiles, of package files
+	// left out of the module zips, e.g. test/ or *.map.
+	ExcludeFiles []string
+
+	// Transform, if set, is called with the directory a package version is
+	// extracted to, the package files below package/, before it's packed as
+	// a module zip. An error from it fails the build.
+	// Tarballs are always repacked on disk when set.
+	Transform TransformFunc
+
+	// FullMetadata fetches the full package documents, which include
+	// publish times, instead of the much smaller abbreviated ones.
+	FullMetadata bool
+
+	// AuthTokens maps hosts, e.g. npm.example.org or localhost:4873,
+	// to bearer tokens sent with all requests to that host, including
+	// redirects from other hosts.
+	AuthTokens map[string]string
+
+	// Transport is used for all requests to the registry and tarball hosts,
+	// e.g. to trust the certificates of a TLS intercepting proxy.
+	// Defaults to http.DefaultTransport, which honors the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	Transport http.RoundTripper
+
+	// Logger is used for all logging. Defaults to DefaultLogger.
+	Logger *log.Logger
+
+	// UserAgent is sent with all requests to the registry.
+	// Defaults to DefaultUserAgent.
+	UserAgent string
+
+	// Contact, e.g. a URL or email address, is appended to the
+	// User-Agent so registry operators can reach whoever runs the proxy.
+	Contact string
+}
+
+// RegistryOverride routes the packages with a name prefix to a registry.
+type RegistryOverride struct {
+	// Prefix is matched against the package name, e.g. @mycorp/.
+	Prefix string
+
+	// Registry is the base URL of the npm registry.
+	Registry string
+
+	// AuthToken, if set, is sent as a bearer token with all
+	// requests to the host of Registry, like AuthTokens.
+	AuthToken string
+}
+
+// DefaultUserAgent returns the default User-Agent, e.g. npmgoproxy/v0.1.0.
+func DefaultUserAgent() string {
+	version := "devel"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, m := range append([]*debug.Module{&bi.Main}, bi.Deps...) {
+			if m.Path == "github.com/bep/npmgoproxy" && m.Version != "" && m.Version != "(devel)" {
+				version = m.Version
+				break
+			}
+		}
+	}
+	return "npmgoproxy/" + version
+}
+
+// Client fetches packages from a npm registry.
+type Client struct {
+	opts          ClientOptions
+	httpClient    *http.Client
+	tarballClient *http.Client
+	urlClient     *http.Client // For URL packages, see CreateZipFromURLPackage.
+
+	// requests limits the number of concurrent upstream requests.
+	// It's shared with the clients returned by Reconfigure.
+	requests chan struct{}
+
+	*clientCache
+}
+
+// clientCache holds the package metadata cached by a Client,
+// shared with the clients returned by Reconfigure.
+type clientCache struct {
+	mu       sync.Mutex
+	packages map[string]cachedPackage
+	versions map[string]cachedVersion // Keyed by pkg@version.
+
+	// shrinkwraps caches the lockfile pins of versions, see FetchShrinkwrap.
+	shrinkwraps map[string]Shrinkwrap // Keyed by pkg@version.
+
+	// refreshing holds the packages being refreshed in the background.
+	refreshing map[string]bool
+
+	// fetching holds the in-flight package document fetches.
+	fetching map[string]*packageCall
+}
+
+type cachedPackage struct {
+	pkg     NpmPackage
+	expires time.Time
+}
+
+type cachedVersion struct {
+	version Version
+	expires time.Time
+}
+
+func NewClient(opts ClientOptions) *Client {
+	if opts.Registry == "" {
+		opts.Registry = DefaultRegistry
+	}
+	opts.Registry = strings.TrimSuffix(opts.Registry, "/")
+	fallbacks := make([]string, len(opts.FallbackRegistries))
+	for i, r := range opts.FallbackRegistries {
+		fallbacks[i] = strings.TrimSuffix(r, "/")
+	}
+	opts.FallbackRegistries = fallbacks
+	overrides := make([]RegistryOverride, len(opts.RegistryOverrides))
+	tokens := make(map[string]string)
+	for host, token := range opts.AuthTokens {
+		tokens[host] = token
+	}
+	for i, o := range opts.RegistryOverrides {
+		o.Registry = strings.TrimSuffix(o.Registry, "/")
+		overrides[i] = o
+		if u, err := url.Parse(o.Registry); err == nil && o.AuthToken != "" {
+			tokens[u.Host] = o.AuthToken
+		}
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return len(overrides[i].Prefix) > len(overrides[j].Prefix)
+	})
+	opts.RegistryOverrides = overrides
+	opts.AuthTokens = tokens
+	if opts.ModulePathBase == "" {
+		opts.ModulePathBase = ModPathBase
+	}
+	if opts.MaxConcurrentRequests <= 0 {
+		opts.MaxConcurrentRequests = DefaultMaxConcurrentRequests
+	}
+	if opts.MaxTarballSize <= 0 {
+		opts.MaxTarballSize = DefaultMaxTarballSize
+	}
+	if opts.MaxPathLength <= 0 {
+		opts.MaxPathLength = DefaultMaxPathLength
+	}
+	if opts.MaxPathDepth <= 0 {
+		opts.MaxPathDepth = DefaultMaxPathDepth
+	}
+	if opts.MetadataTimeout <= 0 {
+		opts.MetadataTimeout = DefaultMetadataTimeout
+	}
+	if opts.TarballTimeout <= 0 {
+		opts.TarballTimeout = DefaultTarballTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = DefaultLogger()
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = DefaultUserAgent()
+	}
+	if opts.Contact != "" {
+		opts.UserAgent += " (+" + opts.Contact + ")"
+	}
+
+	c := &Client{
+		opts: opts,
+		httpClient: &http.Client{
+			Transport: opts.Transport,
+			Timeout:   opts.MetadataTimeout,
+		},
+		tarballClient: &http.Client{
+			Transport: opts.Transport,
+			Timeout:   opts.TarballTimeout,
+		},
+		urlClient: &http.Client{
+			Transport: opts.Transport,
+			Timeout:   opts.TarballTimeout,
+		},
+		requests:    make(chan struct{}, opts.MaxConcurrentRequests),
+		clientCache: newClientCache(),
+	}
+	c.httpClient.CheckRedirect = c.checkRedirect
+	c.tarballClient.CheckRedirect = c.checkRedirect
+	c.urlClient.CheckRedirect = c.checkURLPackageRedirect
+
+	return c
+}
+
+func newClientCache() *clientCache {
+	return &clientCache{
+		packages:    make(map[string]cachedPackage),
+		versions:    make(map[string]cachedVersion),
+		shrinkwraps: make(map[string]Shrinkwrap),
+		refreshing:  make(map[string]bool),
+		fetching:    make(map[string]*packageCall),
+	}
+}
+
+// Reconfigure returns a client configured by opts, e.g. with other auth
+// tokens, sharing the limit of concurrent requests with c, so it holds
+// while requests in flight finish with c. The metadata cache is shared
+// too, unless the registries in opts differ from the ones of c, as the
+// packages may be another's now.
+func (c *Client) Reconfigure(opts ClientOptions) *Client {
+	nc := NewClient(opts)
+	nc.requests = c.requests
+	if sameRegistries(c.opts, nc.opts) {
+		nc.clientCache = c.clientCache
+	}
+	return nc
+}
+
+// sameRegistries reports whether a and b fetch
+// the packages from the same registries.
+func sameRegistries(a, b ClientOptions) bool {
+	if a.Registry != b.Registry || len(a.FallbackRegistries) != len(b.FallbackRegistries) || len(a.RegistryOverrides) != len(b.RegistryOverrides) {
+		return false
+	}
+	for i, r := range a.FallbackRegistries {
+		if r != b.FallbackRegistries[i] {
+			return false
+		}
+	}
+	for i, o := range a.RegistryOverrides {
+		if o.Prefix != b.RegistryOverrides[i].Prefix || o.Registry != b.RegistryOverrides[i].Registry {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) FetchPackage(ctx context.Context, s string) (NpmPackage, error) {
+	if npmp, found := c.cachedPackage(s); found {
+		return npmp, nil
+	}
+	return c.fetchPackage(ctx, s)
+}
+
+// fetchPackage fetches the package document of s from the registry and caches it.
+// Concurrent fetches of the same package share one request, so a popular
+// package expiring from the cache doesn't cause a burst of them.
+func (c *Client) fetchPackage(ctx context.Context, s string) (NpmPackage, error) {
+	c.mu.Lock()
+	call, found := c.fetching[s]
+	if !found {
+		call = &packageCall{done: make(chan struct{})}
+		c.fetching[s] = call
+	}
+	c.mu.Unlock()
+
+	if !found {
+		call.pkg, call.err = c.fetchPackageDocument(ctx, s)
+		c.mu.Lock()
+		delete(c.fetching, s)
+		c.mu.Unlock()
+		close(call.done)
+		return call.pkg, call.err
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return NpmPackage{}, ctx.Err()
+	}
+	if call.err != nil && ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+		// The shared fetch was cancelled by its caller, not this one.
+		return c.fetchPackage(ctx, s)
+	}
+	return call.pkg, call.err
+}
+
+// packageCall is a fetch of a package document shared by concurrent callers.
+type packageCall struct {
+	done chan struct{}
+	pkg  NpmPackage
+	err  error
+}
+
+// fetchPackageDocument fetches the package document of s from the registry and caches it.
+func (c *Client) fetchPackageDocument(ctx context.Context, s string) (NpmPackage, error) {
 	var npmp NpmPackage
-	client := &http.Client{
-		Timeout: time.Second * 10,
+
+	if c.opts.MetadataCacheDir != "" {
+		npmp, fetched, err := c.loadPackageDocument(s)
+		switch {
+		case err == nil && (c.opts.Offline || time.Since(fetched) < c.opts.MetadataTTL):
+			c.cachePackageFetched(s, npmp, fetched)
+			return npmp, nil
+		case c.opts.Offline:
+			return npmp, err
+		case err != nil && !errors.Is(err, ErrPackageNotFound):
+			c.logf(ctx, "warning: ignoring the stored package document of %s: %s", s, err)
+		}
+	}
+
+	accept := "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8"
+	if c.opts.FullMetadata {
+		accept = "application/json"
 	}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://registry.npmjs.org/%s", s), nil)
+	r, err := c.get(ctx, c.httpClient, c.registryURLs(s), accept)
 	if err != nil {
 		return npmp, err
 	}
-	req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
 
-	r, err := client.Do(req)
+	defer r.Body.Close()
+
+	if err := checkStatus(r); err != nil {
+		if r.StatusCode == http.StatusNotFound {
+			if lower := strings.ToLower(s); lower != s {
+				return npmp, fmt.Errorf("package %q: %w, did you mean %q?", s, ErrUppercasePackageName, lower)
+			}
+			return npmp, fmt.Errorf("package %q: %w", s, ErrPackageNotFound)
+		}
+		return npmp, err
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		return npmp, fmt.Errorf("package %q: failed to read registry response: %w", s, err)
+	}
+	npmp, err = c.decodePackageDocument(s, b)
 	if err != nil {
 		return npmp, err
 	}
+	fetched := time.Now()
+	c.cachePackageFetched(s, npmp, fetched)
+	if err := c.storePackageDocument(s, b, fetched); err != nil {
+		c.logf(ctx, "error: failed to store the package document of %s: %s", s, err)
+	}
+
+	return npmp, nil
+}
+
+// decodePackageDocument decodes the package document b of s.
+func (c *Client) decodePackageDocument(s string, b []byte) (NpmPackage, error) {
+	var npmp NpmPackage
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&npmp); err != nil {
+		if err == io.EOF {
+			return npmp, fmt.Errorf("package %q: empty response from registry", s)
+		}
+		return npmp, fmt.Errorf("package %q: failed to decode registry response: %w", s, err)
+	}
+	for i := range npmp.Versions {
+		c.resolveTarballURL(s, &npmp.Versions[i].Dist)
+	}
+	return npmp, nil
+}
+
+// decodeJSON decodes the JSON body of r into v.
+// The transport asks for and decompresses gzipped responses by itself,
+// but a body still gzip encoded, e.g. when a custom Transport sets
+// Accept-Encoding, is decompressed here.
+func decodeJSON(r *http.Response, v interface{}) error {
+	body, err := decompressedBody(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// readBody reads the body of r, decompressed as in decodeJSON.
+func readBody(r *http.Response) ([]byte, error) {
+	body, err := decompressedBody(r)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// decompressedBody returns the body of r, gunzipped if still gzip encoded.
+func decompressedBody(r *http.Response) (io.ReadCloser, error) {
+	if !r.Uncompressed && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return gzip.NewReader(r.Body)
+	}
+	return io.NopCloser(r.Body), nil
+}
+
+// resolveTarballURL resolves a relative tarball URL in dist, as returned
+// by some private registries, against the registry of the package pkg.
+func (c *Client) resolveTarballURL(pkg string, dist *Dist) {
+	u, err := url.Parse(dist.Tarball)
+	if err != nil || u.IsAbs() || dist.Tarball == "" {
+		return
+	}
+	base, err := url.Parse(c.registry(pkg) + "/")
+	if err != nil {
+		return
+	}
+	dist.Tarball = base.ResolveReference(u).String()
+}
+
+// registry returns the base URL of the registry serving the package p.
+func (c *Client) registry(p string) string {
+	if o, found := c.registryOverride(p); found {
+		return o.Registry
+	}
+	return c.opts.Registry
+}
+
+// registryOverride returns the registry override matching the package in p, if any.
+func (c *Client) registryOverride(p string) (RegistryOverride, bool) {
+	for _, o := range c.opts.RegistryOverrides {
+		if strings.HasPrefix(p, o.Prefix) {
+			return o, true
+		}
+	}
+	return RegistryOverride{}, false
+}
+
+// registryURLs returns the URLs of p in the registry and its fallbacks, in order,
+// or in the override registry if the package in p matches one.
+func (c *Client) registryURLs(p string) []string {
+	if o, found := c.registryOverride(p); found {
+		return []string{o.Registry + "/" + p}
+	}
+	urls := []string{c.opts.Registry + "/" + p}
+	for _, r := range c.opts.FallbackRegistries {
+		urls = append(urls, r+"/"+p)
+	}
+	return urls
+}
+
+// tarballURLs returns the URLs to try for the tarball at u, in order.
+// Tarballs hosted by one of the registries are also looked for in the others.
+func (c *Client) tarballURLs(u string) []string {
+	for _, r := range append([]string{c.opts.Registry}, c.opts.FallbackRegistries...) {
+		if strings.HasPrefix(u, r+"/") {
+			urls := []string{u}
+			for _, candidate := range c.registryURLs(strings.TrimPrefix(u, r+"/")) {
+				if candidate != u {
+					urls = append(urls, candidate)
+				}
+			}
+			return urls
+		}
+	}
+	return []string{u}
+}
+
+// get requests the urls in order until one responds without a transport
+// or server error, which are wrapped in ErrRegistryUnavailable.
+// The caller must check the status of the returned response.
+func (c *Client) get(ctx context.Context, hc *http.Client, urls []string, accept string) (*http.Response, error) {
+	if c.opts.Offline {
+		return nil, fmt.Errorf("%s: %w", strings.Join(urls, ", "), ErrOffline)
+	}
+	var lastErr error
+	for i, u := range urls {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := c.do(hc, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = unavailable(err, hc.Timeout)
+		} else if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = checkStatus(resp)
+		} else {
+			if i > 0 {
+				c.logf(ctx, "served %s from fallback registry", u)
+			}
+			return resp, nil
+		}
+
+		if i < len(urls)-1 {
+			c.logf(ctx, "warning: %s: %s, trying next registry", u, lastErr)
+		}
+	}
+	return nil, lastErr
+}
+
+// logf logs using the configured logger, prefixed with the request ID in ctx, if any.
+func (c *Client) logf(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, c.opts.Logger, format, args...)
+}
+
+// do sends req using hc with the configured User-Agent and the
+// request ID carried by its context, if any, first waiting for a free slot if
+// MaxConcurrentRequests requests are already in flight.
+// The slot is released when the response body is closed.
+func (c *Client) do(hc *http.Client, req *http.Request) (*http.Response, error) {
+	select {
+	case c.requests <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-c.requests }
+
+	req.Header.Set("User-Agent", c.opts.UserAgent)
+	if id := RequestID(req.Context()); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	c.setAuth(req)
+	resp, err := hc.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// unavailable wraps a transport error from the registry in ErrRegistryUnavailable,
+// noting the client timeout if the request took longer.
+// Errors from cancelled request contexts must be handled by the caller.
+func unavailable(err error, timeout time.Duration) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return unavailableError{err}
+}
+
+// unavailableError is ErrRegistryUnavailable caused by the transport error err,
+// which is still available to errors.Is and errors.As, e.g. as a *url.Error.
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return ErrRegistryUnavailable.Error() + ": " + e.err.Error()
+}
+func (e unavailableError) Unwrap() error        { return e.err }
+func (e unavailableError) Is(target error) bool { return target == ErrRegistryUnavailable }
+
+// checkStatus returns an error if resp isn't a 200 OK,
+// wrapping ErrRegistryUnavailable for server errors and
+// ErrRegistryUnauthorized for auth errors.
+func checkStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: %s", ErrRegistryUnavailable, resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %s", ErrRegistryUnauthorized, resp.Status)
+	default:
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+}
+
+// setAuth sets the auth token configured for the host of req, if any.
+func (c *Client) setAuth(req *http.Request) bool {
+	token, found := c.opts.AuthTokens[req.URL.Host]
+	if found {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return found
+}
+
+// checkRedirect applies the auth token configured for the redirect target,
+// e.g. a CDN serving tarballs for a private registry. The http.Client keeps
+// or drops the Authorization header based on the host name only.
+// Redirecting an authenticated request to a host without a token fails
+// instead of silently dropping the authentication.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	req.Header.Del("Authorization")
+	if c.setAuth(req) {
+		return nil
+	}
+	if via[0].Header.Get("Authorization") != "" {
+		return fmt.Errorf("redirect from %s to %s would drop authentication, no auth token configured for %s", via[0].URL.Host, req.URL.Host, req.URL.Host)
+	}
+	return nil
+}
+
+// releaseReadCloser calls release once on Close.
+type releaseReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// VersionInfo describes a published version of a package.
+type VersionInfo struct {
+	// Version is the Go semver version, e.g. v1.2.3.
+	Version string
+
+	// Time is the publish time, zero if not known, see ClientOptions.FullMetadata.
+	Time time.Time
+
+	// Prerelease is set for pre-release versions, e.g. v2.0.0-beta.1.
+	Prerelease bool
+}
+
+// Versions returns the versions of pkg sorted in ascending semver order,
+// leaving out the ones without a tarball, see Version.HasTarball.
+func (c *Client) Versions(ctx context.Context, pkg string) ([]VersionInfo, error) {
+	npmpkg, err := c.FetchPackage(ctx, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]VersionInfo, 0, len(npmpkg.Versions))
+	for _, v := range npmpkg.Versions {
+		if !v.HasTarball() {
+			continue
+		}
+		infos = append(infos, VersionInfo{
+			Version:    v.Version,
+			Time:       npmpkg.Time.Versions[v.Version],
+			Prerelease: semver.Prerelease(v.Version) != "",
+		})
+	}
+	return infos, nil
+}
+
+// PublishTime returns the publish time of version of pkg, or the zero time
+// if not known. Only the full package documents have the publish times,
+// so without ClientOptions.FullMetadata this doesn't fetch anything.
+func (c *Client) PublishTime(ctx context.Context, pkg, version string) (time.Time, error) {
+	if !c.opts.FullMetadata {
+		return time.Time{}, nil
+	}
+	npmpkg, err := c.FetchPackage(ctx, pkg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return npmpkg.Time.Versions[version], nil
+}
+
+// ResolveDependency returns the version of dep's package best matching its version range.
+func (c *Client) ResolveDependency(ctx context.Context, dep Dependency) (Version, error) {
+	npmpkg, err := c.FetchPackage(ctx, dep.Name)
+	if err != nil {
+		return Version{}, err
+	}
+	return npmpkg.ResolveRange(dep.VersionRange)
+}
+
+// Forget removes pkg from the metadata cache.
+// It reports whether the package was cached.
+func (c *Client) Forget(pkg string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.packages[pkg]
+	delete(c.packages, pkg)
+	for key := range c.versions {
+		if strings.HasPrefix(key, pkg+"@") {
+			delete(c.versions, key)
+			found = true
+		}
+	}
+	for key := range c.shrinkwraps {
+		if strings.HasPrefix(key, pkg+"@") {
+			delete(c.shrinkwraps, key)
+		}
+	}
+	return found
+}
+
+// CachedPackages returns the number of package documents in the metadata cache.
+func (c *Client) CachedPackages() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.packages)
+}
+
+func (c *Client) cachedPackage(pkg string) (NpmPackage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp, found := c.packages[pkg]
+	if !found {
+		return NpmPackage{}, false
+	}
+	if now := time.Now(); now.After(cp.expires) {
+		if now.After(cp.expires.Add(c.opts.MetadataStaleWhileRevalidate)) {
+			delete(c.packages, pkg)
+			return NpmPackage{}, false
+		}
+		if !c.refreshing[pkg] {
+			c.refreshing[pkg] = true
+			go c.refreshPackage(pkg)
+		}
+	}
+	return cp.pkg, true
+}
+
+// refreshPackage fetches the stale package document of pkg again,
+// see ClientOptions.MetadataStaleWhileRevalidate.
+// The stale document is kept if that fails.
+func (c *Client) refreshPackage(pkg string) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.refreshing, pkg)
+		c.mu.Unlock()
+	}()
+	ctx := context.Background()
+	if _, err := c.fetchPackage(ctx, pkg); err != nil {
+		c.logf(ctx, "warning: failed to refresh package %q: %s", pkg, err)
+	}
+}
+
+// metadataTTL returns MetadataTTL spread by MetadataTTLJitter.
+func (c *Client) metadataTTL() time.Duration {
+	ttl := c.opts.MetadataTTL
+	if jitter := c.opts.MetadataTTLJitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		ttl += time.Duration((2*rand.Float64() - 1) * jitter * float64(ttl))
+	}
+	return ttl
+}
+
+func (c *Client) cachePackage(pkg string, npmp NpmPackage) {
+	c.cachePackageFetched(pkg, npmp, time.Now())
+}
+
+// cachePackageFetched caches npmp, fetched from the registry at fetched,
+// e.g. when it was stored in ClientOptions.MetadataCacheDir.
+func (c *Client) cachePackageFetched(pkg string, npmp NpmPackage, fetched time.Time) {
+	if c.opts.MetadataTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packages[pkg] = cachedPackage{pkg: npmp, expires: fetched.Add(c.metadataTTL())}
+}
+
+// FetchPackageVersion fetches version of the npm package pack.
+// If the package document isn't cached, the registry's per-version endpoint
+// is tried first to avoid downloading the full package document.
+// An empty version or a dist-tag, e.g. latest, is resolved via the
+// package's dist-tags, the empty version to the latest one.
+func (c *Client) FetchPackageVersion(ctx context.Context, pack, version string) (Version, error) {
+	if version == "" || (!semver.IsValid(version) && IsDistTag(version)) {
+		npmpkg, err := c.FetchPackage(ctx, pack)
+		if err != nil {
+			return Version{}, err
+		}
+		return npmpkg.lookupDistTag(pack, version)
+	}
+
+	if npmpkg, found := c.cachedPackage(pack); found {
+		return npmpkg.lookupVersion(pack, version)
+	}
+
+	if npmv, found := c.cachedVersion(pack, version); found {
+		return npmv, nil
+	}
+
+	if c.opts.MetadataCacheDir == "" {
+		if npmv, err := c.fetchVersion(ctx, pack, version); err == nil {
+			c.cacheVersion(pack, npmv)
+			return npmv, nil
+		}
+	}
+
+	// Fall back to the full package document, which also
+	// tells unpublished versions apart from missing ones.
+	npmpkg, err := c.FetchPackage(ctx, pack)
+	if err != nil {
+		return Version{}, err
+	}
+
+	return npmpkg.lookupVersion(pack, version)
+}
+
+// fetchVersion fetches a single version document from the registry.
+func (c *Client) fetchVersion(ctx context.Context, pack, version string) (Version, error) {
+	var npmv Version
+
+	r, err := c.get(ctx, c.httpClient, c.registryURLs(pack+"/"+strings.TrimPrefix(version, "v")), "application/json")
+	if err != nil {
+		return npmv, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return npmv, fmt.Errorf("bad status: %s", r.Status)
+	}
+
+	if err := decodeJSON(r, &npmv); err != nil {
+		return npmv, err
+	}
+	npmv.Version = normalizeSemver(npmv.Version)
+	if npmv.Name == "" {
+		npmv.Name = pack
+	}
+	c.resolveTarballURL(pack, &npmv.Dist)
+
+	if npmv.Version != version {
+		return npmv, fmt.Errorf("got version %q, expected %q", npmv.Version, version)
+	}
+
+	return npmv, nil
+}
+
+func (c *Client) cachedVersion(pkg, version string) (Version, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := pkg + "@" + version
+	cv, found := c.versions[key]
+	if !found {
+		return Version{}, false
+	}
+	if time.Now().After(cv.expires) {
+		delete(c.versions, key)
+		return Version{}, false
+	}
+	return cv.version, true
+}
+
+func (c *Client) cacheVersion(pkg string, v Version) {
+	if c.opts.MetadataTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[pkg+"@"+v.Version] = cachedVersion{version: v, expires: time.Now().Add(c.metadataTTL())}
+}
+
+// TransformFunc modifies the files of version extracted to dir,
+// e.g. adding a go.mod or a LICENSE, before they're packed as a module zip.
+type TransformFunc func(ctx context.Context, version Version, dir string) error
+
+// CreateZipFromVersion downloads the tarball of last and repacks it as a
+// Go module zip. Tarballs up to ClientOptions.MaxInMemorySize are repacked
+// in memory, larger ones in a temp dir in the work dir.
+// Closing the returned zip removes any temp files.
+func (c *Client) CreateZipFromVersion(ctx context.Context, last Version) (nameReadSeekCloser, error) {
+	t, err := c.spillTarball(ctx, last, c.zipThreshold())
+	if err != nil {
+		return nil, err
+	}
+	return c.repackSpilledTarball(ctx, t, last)
+}
+
+// zipThreshold is the size up to which tarballs are repacked in memory.
+func (c *Client) zipThreshold() int64 {
+	if c.opts.Transform != nil {
+		// The transform works on the extracted files.
+		return 0
+	}
+	return c.opts.MaxInMemorySize
+}
+
+// repackSpilledTarball repacks the tarball t of version as a module zip,
+// removing any temp files of t on failure or when the zip is closed.
+func (c *Client) repackSpilledTarball(ctx context.Context, t spilledTarball, version Version) (nameReadSeekCloser, error) {
+	if t.filename == "" {
+		return c.repackTarballInMemory(ctx, t.b, version)
+	}
+
+	f, err := c.repackTarballAsZip(ctx, t.filename, version)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		t.remove()
+		return nil, err
+	}
+	return tempFile{File: f, dir: t.dir}, nil
+}
+
+// DownloadTarball downloads and verifies the tarball of v as published.
+// Tarballs up to ClientOptions.MaxInMemorySize are kept in memory,
+// larger ones in a temp dir in the work dir.
+// Closing the returned tarball removes any temp files.
+func (c *Client) DownloadTarball(ctx context.Context, v Version) (nameReadSeekCloser, error) {
+	t, err := c.spillTarball(ctx, v, c.opts.MaxInMemorySize)
+	if err != nil {
+		return nil, err
+	}
+	if t.filename == "" {
+		return memZip{Reader: bytes.NewReader(t.b), name: fileName(v.Name) + ".tgz"}, nil
+	}
+	f, err := os.Open(t.filename)
+	if err != nil {
+		t.remove()
+		return nil, err
+	}
+	return tempFile{File: f, dir: t.dir}, nil
+}
+
+// fileName returns a single file name component for the temp files of a
+// package version, joining the parts, e.g. its name and version, with a -.
+// The parts are path escaped, so the / in scoped package names, e.g.
+// @scope/foo, doesn't create nested directories and distinct names
+// don't collide, as @a/b_c and @a_b/c would if / were replaced by _.
+func fileName(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	return strings.Join(escaped, "-")
+}
 
-	defer r.Body.Close()
+// spilledTarball is a downloaded tarball, either in memory or, if larger
+// than the threshold, in the file filename in the temp dir dir.
+type spilledTarball struct {
+	b        []byte
+	filename string
+	dir      string
+}
 
-	err = json.NewDecoder(r.Body).Decode(&npmp)
-	if err == io.EOF {
-		err = nil
+func (t spilledTarball) remove() {
+	if t.dir != "" {
+		os.RemoveAll(t.dir)
 	}
+}
 
-	return npmp, err
+// spillTarball downloads and verifies the tarball of v, in memory up to
+// threshold bytes, spilling to a temp dir in the work dir if larger.
+func (c *Client) spillTarball(ctx context.Context, v Version, threshold int64) (spilledTarball, error) {
+	return c.spill(v.Name, threshold, func(w io.Writer) error {
+		return c.fetchTarball(ctx, v.Dist, w)
+	})
 }
 
-func FetchPackageVersion(pack, version string) (Version, error) {
-	npmpkg, err := FetchPackage(pack)
-	if err != nil {
-		return Version{}, err
+// spill writes the tarball named name written by fetch in memory up to
+// threshold bytes, spilling to a temp dir in the work dir if larger.
+func (c *Client) spill(name string, threshold int64, fetch func(w io.Writer) error) (spilledTarball, error) {
+	var t spilledTarball
+	buf := &spillBuffer{
+		threshold: threshold,
+		create: func() (*os.File, error) {
+			var err error
+			t.dir, err = os.MkdirTemp(c.opts.WorkDir, "npmgop")
+			if err != nil {
+				return nil, err
+			}
+			t.filename = filepath.Join(t.dir, fileName(name))
+			return os.Create(t.filename)
+		},
 	}
 
-	npmv, found := npmpkg.Versions.ByVersion(version)
-	if !found {
-		return npmv, fmt.Errorf("version %q not found for package %q", version, pack)
+	err := fetch(buf)
+	if buf.f != nil {
+		if cerr := buf.f.Close(); err == nil {
+			err = cerr
+		}
 	}
-	return npmv, nil
-}
-
-func CreateZipFromVersion(last Version) (nameReadSeekCloser, error) {
-	tempDir, err := ioutil.TempDir("", "npmgop")
 	if err != nil {
-		return nil, err
+		t.remove()
+		return spilledTarball{}, fmt.Errorf("failed to download tarball: %w", err)
 	}
-	tarFilename := filepath.Join(tempDir, strings.ReplaceAll(last.Name, "/", "_"))
-	if err := downloadTarball(last.Dist, tarFilename); err != nil {
-		return nil, fmt.Errorf("failed to download tarball: %s", err)
+
+	if buf.f == nil {
+		t.b = buf.buf.Bytes()
 	}
-	return repackTarballAsZip(tarFilename, last)
+	return t, nil
+}
+
+// tempFile is a file in the temp dir dir, which is removed on Close.
+type tempFile struct {
+	*os.File
+	dir string
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.RemoveAll(f.dir)
+	return err
 }
 
 type Dependencies []Dependency
@@ -112,12 +1226,16 @@ type Dependency struct {
 }
 
 type Dist struct {
-	ShaSum  string `json:"shasum"`
-	Tarball string `json:"tarball"`
+	ShaSum    string `json:"shasum"`
+	Integrity string `json:"integrity"`
+	Tarball   string `json:"tarball"`
 }
 
 type DistTags struct {
 	Latest string
+
+	// Tags maps all dist-tags, including latest, to their version.
+	Tags map[string]string
 }
 
 func (tags *DistTags) UnmarshalJSON(b []byte) error {
@@ -126,21 +1244,305 @@ func (tags *DistTags) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	tags.Latest = normalizeSemver(m["latest"])
+	tags.Tags = make(map[string]string)
+	for k, v := range m {
+		tags.Tags[k] = normalizeSemver(v)
+	}
+	tags.Latest = tags.Tags["latest"]
 	return nil
 }
 
+// NpmPackage is a npm package document, either the full document
+// or the abbreviated one used by npm install, which has no time field
+// but a top level modified.
 type NpmPackage struct {
 	Name     string   `json:"name"`
 	DistTags DistTags `json:"dist-tags"`
 	Versions Versions `json:"versions"`
+	Time     Time     `json:"time"`
+
+	// Repository is the source repository of the latest version,
+	// only available in the full package document, see ClientOptions.FullMetadata.
+	// It is the default for versions not declaring one.
+	Repository *Repository `json:"repository"`
+
+	// index maps versions to their position in Versions, see ByVersion.
+	index map[string]int
+}
+
+func (p *NpmPackage) UnmarshalJSON(b []byte) error {
+	type npmPackage NpmPackage
+	var pp struct {
+		npmPackage
+		Modified time.Time `json:"modified"`
+	}
+	if err := json.Unmarshal(b, &pp); err != nil {
+		return err
+	}
+	*p = NpmPackage(pp.npmPackage)
+	if p.Time.Modified.IsZero() {
+		p.Time.Modified = pp.Modified
+	}
+	// The abbreviated documents may leave out the name in the versions.
+	for i := range p.Versions {
+		if p.Versions[i].Name == "" {
+			p.Versions[i].Name = p.Name
+		}
+		if p.Versions[i].Repository == nil {
+			p.Versions[i].Repository = p.Repository
+		}
+	}
+	p.index = p.Versions.index()
+	return nil
+}
+
+// ByVersion returns the version v of p, looked up in the index
+// built when decoding the package document, which avoids scanning
+// the thousands of versions of some packages on every lookup.
+func (p NpmPackage) ByVersion(v string) (Version, bool) {
+	if p.index == nil {
+		return p.Versions.ByVersion(v)
+	}
+	i, found := p.index[v]
+	if !found || i >= len(p.Versions) || p.Versions[i].Version != v {
+		// Versions has been modified since the index was built.
+		return p.Versions.ByVersion(v)
+	}
+	return p.Versions[i], true
+}
+
+func (p NpmPackage) lookupVersion(pack, version string) (Version, error) {
+	npmv, found := p.ByVersion(version)
+	if !found {
+		if p.IsUnpublished(version) {
+			return npmv, fmt.Errorf("version %q of package %q: %w", version, pack, ErrVersionUnpublished)
+		}
+		return npmv, fmt.Errorf("version %q of package %q: %w", version, pack, ErrVersionNotFound)
+	}
+	return npmv, nil
+}
+
+// lookupDistTag returns the version of p tagged with tag, latest if tag is empty.
+func (p NpmPackage) lookupDistTag(pack, tag string) (Version, error) {
+	if tag == "" {
+		tag = "latest"
+	}
+	version, found := p.DistTags.Tags[tag]
+	if !found {
+		return Version{}, fmt.Errorf("dist-tag %q of package %q: %w", tag, pack, ErrVersionNotFound)
+	}
+	return p.lookupVersion(pack, version)
+}
+
+// IsUnpublished reports whether version v has been unpublished from the registry.
+func (p NpmPackage) IsUnpublished(v string) bool {
+	for _, uv := range p.Time.Unpublished {
+		if uv == v {
+			return true
+		}
+	}
+	// Unpublished versions are removed from versions, but kept in time.
+	if _, found := p.Time.Versions[v]; found {
+		_, found = p.ByVersion(v)
+		return !found
+	}
+	return false
+}
+
+// Time holds the publish times of a package.
+// This is only available in the full package document,
+// see ClientOptions.FullMetadata, except for Modified.
+type Time struct {
+	Created  time.Time
+	Modified time.Time
+
+	// Versions maps versions, including unpublished ones, to their publish time.
+	Versions map[string]time.Time
+
+	// Unpublished holds the versions of an unpublished package.
+	Unpublished []string
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	t.Versions = make(map[string]time.Time)
+
+	for k, v := range m {
+		switch k {
+		case "unpublished":
+			var unpublished struct {
+				Versions []string `json:"versions"`
+			}
+			if err := json.Unmarshal(v, &unpublished); err != nil {
+				return err
+			}
+			for _, uv := range unpublished.Versions {
+				t.Unpublished = append(t.Unpublished, normalizeSemver(uv))
+			}
+		default:
+			var tt time.Time
+			if err := json.Unmarshal(v, &tt); err != nil {
+				return err
+			}
+			switch k {
+			case "created":
+				t.Created = tt
+			case "modified":
+				t.Modified = tt
+			default:
+				t.Versions[normalizeSemver(k)] = tt
+			}
+		}
+	}
+
+	return nil
 }
 
 type Version struct {
 	Name         string       `json:"name"`
 	Version      string       `json:"version"`
 	Dependencies Dependencies `json:"dependencies"`
-	Dist         Dist         `json:"dist"`
+
+	// OptionalDependencies are used if found, but installation
+	// of the package doesn't fail without them.
+	OptionalDependencies Dependencies `json:"optionalDependencies"`
+
+	// PeerDependencies are expected to be provided by the
+	// package's host, e.g. a plugin's framework.
+	PeerDependencies Dependencies `json:"peerDependencies"`
+
+	// Bin maps the names of the commands the package provides to
+	// the files implementing them, relative to the package root.
+	// The files are repacked as any other, but Go module zips
+	// don't preserve file modes, so they're not executable.
+	Bin map[string]string `json:"-"`
+
+	// Engines holds the declared runtime constraints, e.g. {"node": ">=14"}.
+	Engines Engines `json:"engines"`
+
+	// Deprecated is the deprecation message of deprecated versions.
+	Deprecated Deprecated `json:"deprecated"`
+
+	// HasShrinkwrap tells whether the tarball has a npm-shrinkwrap.json,
+	// nil if the registry doesn't say.
+	HasShrinkwrap *bool `json:"_hasShrinkwrap"`
+
+	// Repository is the source repository, if declared.
+	Repository *Repository `json:"repository"`
+
+	// Types is the package's bundled TypeScript declaration file,
+	// e.g. dist/index.d.ts, from the types field or its older
+	// alias typings.
+	Types string `json:"types"`
+
+	Dist Dist `json:"dist"`
+}
+
+// Repository is the source repository of a package.
+type Repository struct {
+	Type string // e.g. git
+	URL  string // e.g. git+https://github.com/vuejs/core.git or github:user/repo
+
+	// Directory is the package's directory in monorepos, e.g. packages/reactivity.
+	Directory string
+}
+
+func (r *Repository) UnmarshalJSON(b []byte) error {
+	// The repository field is either an object or a URL,
+	// possibly a shorthand such as github:user/repo or user/repo.
+	var u string
+	if err := json.Unmarshal(b, &u); err == nil {
+		*r = Repository{URL: u}
+		return nil
+	}
+	var rr struct {
+		Type      string `json:"type"`
+		URL       string `json:"url"`
+		Directory string `json:"directory"`
+	}
+	if err := json.Unmarshal(b, &rr); err != nil {
+		// Ignore other shapes, as npm does.
+		return nil
+	}
+	*r = Repository(rr)
+	return nil
+}
+
+// Deprecated is the deprecation message of a version, empty if not deprecated.
+type Deprecated string
+
+func (d *Deprecated) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*d = Deprecated(s)
+		return nil
+	}
+	// Some registries use booleans.
+	var deprecated bool
+	if err := json.Unmarshal(b, &deprecated); err == nil && deprecated {
+		*d = "deprecated"
+	}
+	return nil
+}
+
+// Engines maps runtimes, e.g. node, to version ranges.
+type Engines map[string]string
+
+func (e *Engines) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		// Some old packages have e.g. an array of strings,
+		// which npm ignores.
+		return nil
+	}
+	*e = m
+	return nil
+}
+
+func (v *Version) UnmarshalJSON(b []byte) error {
+	type version Version
+	var vv struct {
+		version
+		Bin     json.RawMessage `json:"bin"`
+		Types   json.RawMessage `json:"types"`
+		Typings json.RawMessage `json:"typings"`
+	}
+	if err := json.Unmarshal(b, &vv); err != nil {
+		return err
+	}
+	*v = Version(vv.version)
+
+	// Anything but a string, e.g. an array in some old packages, is ignored.
+	for _, types := range []json.RawMessage{vv.Types, vv.Typings} {
+		if err := json.Unmarshal(types, &v.Types); err == nil && v.Types != "" {
+			break
+		}
+		v.Types = ""
+	}
+
+	if len(vv.Bin) == 0 || string(vv.Bin) == "null" {
+		return nil
+	}
+
+	// The bin field is either a map or a single file for a command
+	// named after the package without its scope.
+	var file string
+	if err := json.Unmarshal(vv.Bin, &file); err == nil {
+		v.Bin = map[string]string{path.Base(v.Name): file}
+		return nil
+	}
+	return json.Unmarshal(vv.Bin, &v.Bin)
+}
+
+// HasTarball reports whether v has a tarball to build a module zip from.
+// Some registries list placeholder versions without one, e.g. the
+// security holding versions of removed packages.
+func (v Version) HasTarball() bool {
+	return v.Dist.Tarball != ""
 }
 
 type Versions []Version
@@ -154,14 +1556,36 @@ func (vs Versions) ByVersion(v string) (ver Version, found bool) {
 	return
 }
 
+func (vs Versions) index() map[string]int {
+	m := make(map[string]int, len(vs))
+	for i, v := range vs {
+		m[v.Version] = i
+	}
+	return m
+}
+
 func (vs *Versions) UnmarshalJSON(b []byte) error {
 	var m map[string]Version
 	err := json.Unmarshal(b, &m)
 	if err != nil {
 		return err
 	}
-	for _, version := range m {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Versions differing only in build metadata are the same Go version,
+	// keep the first.
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		version := m[k]
 		version.Version = normalizeSemver(version.Version)
+		if seen[version.Version] {
+			continue
+		}
+		seen[version.Version] = true
 		*vs = append(*vs, version)
 	}
 
@@ -182,49 +1606,75 @@ type nameReadSeekCloser interface {
 	Name() string
 }
 
-func downloadTarball(dist Dist, target string) (err error) {
+// downloadTarball downloads and verifies the tarball of dist to the file target.
+func (c *Client) downloadTarball(ctx context.Context, dist Dist, target string) (err error) {
 	f, err := os.Create(target)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(target)
+		}
+	}()
 
-	resp, err := http.Get(dist.Tarball)
+	return c.fetchTarball(ctx, dist, f)
+}
+
+// fetchTarball downloads and verifies the tarball of dist, writing it to w.
+func (c *Client) fetchTarball(ctx context.Context, dist Dist, w io.Writer) error {
+	resp, err := c.get(ctx, c.tarballClient, c.tarballURLs(dist.Tarball), "")
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	if err := checkStatus(resp); err != nil {
+		return err
 	}
 
-	h := sha1.New()
-	out := io.MultiWriter(f, h)
+	verifier := newTarballVerifier(dist)
+	out := io.MultiWriter(w, verifier)
 
-	_, err = io.Copy(out, resp.Body)
+	// Read one byte past the limit to tell a too large tarball from one of exactly the limit.
+	n, err := io.Copy(out, io.LimitReader(resp.Body, c.opts.MaxTarballSize+1))
 	if err != nil {
 		return err
 	}
+	if n > c.opts.MaxTarballSize {
+		return fmt.Errorf("%s: %w: exceeds %d bytes", dist.Tarball, ErrTarballTooLarge, c.opts.MaxTarballSize)
+	}
 
-	shasumFile := hex.EncodeToString(h.Sum(nil)[:])
-	if shasumFile != dist.ShaSum {
-		return errors.New("shasum mismatch")
+	check, fallback, err := verifier.verify(c.opts.Verification)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dist.Tarball, err)
+	}
+	// Only note the checks falling short of the policy, not every download.
+	if check == "none" {
+		c.logf(ctx, "warning: %s has no shasum or integrity, skipped verification (%s)", dist.Tarball, c.opts.Verification)
+	} else if fallback {
+		c.logf(ctx, "verified %s using %s only (%s)", dist.Tarball, check, c.opts.Verification)
 	}
 
 	return nil
 }
 
+// normalizeSemver makes the npm version s a Go module version, e.g. 1.2.3+build.5 becomes v1.2.3.
+// Build metadata is stripped everywhere, as Go module versions can't have it and
+// it doesn't take part in version precedence anyway.
 func normalizeSemver(s string) string {
-	// Make the version Go semver compatible.
+	if i := strings.Index(s, "+"); i != -1 {
+		s = s[:i]
+	}
 	if !strings.HasPrefix(s, "v") {
 		s = "v" + s
 	}
 	return s
 }
 
-func repackTarballAsZip(tarFilename string, version Version) (nameReadSeekCloser, error) {
-	tarDir := filepath.Join(filepath.Dir(tarFilename), fmt.Sprintf("%s-%s-%s", version.Name, version.Version, version.Dist.ShaSum))
+func (c *Client) repackTarballAsZip(ctx context.Context, tarFilename string, version Version) (*os.File, error) {
+	tarDir := filepath.Join(filepath.Dir(tarFilename), fileName(version.Name, version.Version, version.Dist.ShaSum))
 	if err := os.MkdirAll(tarDir, 0o755); err != nil {
 		return nil, err
 	}
@@ -234,8 +1684,30 @@ func repackTarballAsZip(tarFilename string, version Version) (nameReadSeekCloser
 	}
 	defer tf.Close()
 
-	if err := untar(tarDir, tf); err != nil {
-		return nil, fmt.Errorf("failed to untar: %s", err)
+	if err := c.untar(ctx, tarDir, tf); err != nil {
+		return nil, fmt.Errorf("failed to untar: %w", err)
+	}
+	if err := checkModuleDir(tarDir); err != nil {
+		return nil, invalidModuleError{err}
+	}
+	if c.opts.RequireSource {
+		if err := checkSourceDir(tarDir); err != nil {
+			return nil, invalidModuleError{fmt.Errorf("%s@%s: %w", version.Name, version.Version, err)}
+		}
+	}
+	if c.opts.DocGo {
+		// The npm package files are all below package/, but don't overwrite anything.
+		docFilename := filepath.Join(tarDir, docGoName)
+		if _, err := os.Lstat(docFilename); os.IsNotExist(err) {
+			if err := os.WriteFile(docFilename, docGo(version), 0o644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.opts.Transform != nil {
+		if err := c.opts.Transform(ctx, version, tarDir); err != nil {
+			return nil, fmt.Errorf("failed to transform %s@%s: %w", version.Name, version.Version, err)
+		}
 	}
 	zipFilename := tarFilename + ".zip"
 	f, err := os.Create(zipFilename)
@@ -243,34 +1715,118 @@ func repackTarballAsZip(tarFilename string, version Version) (nameReadSeekCloser
 		return nil, err
 	}
 
-	major := semver.Major(version.Version)
-	if major == "v1" || major == "v0" {
-		major = ""
+	// The zip only depends on the extracted files, not on the tarball entry
+	// order or mtimes: CreateFromDir walks dir in lexical order and writes
+	// the entries without timestamps, so rebuilds are byte-identical.
+	if err := zip.CreateFromDir(f, module.Version{Path: VersionModulePath(c.opts.ModulePathBase, version.Name, version.Version), Version: version.Version}, tarDir); err != nil {
+		return f, invalidModuleError{err}
 	}
+	return f, nil
+}
+
+// invalidModuleError marks err as an ErrInvalidModule, keeping its message.
+type invalidModuleError struct {
+	err error
+}
 
-	return f, zip.CreateFromDir(f, module.Version{Path: path.Join(ModPathBase, EscapePackage(version.Name), major), Version: version.Version}, tarDir)
+func (e invalidModuleError) Error() string        { return e.err.Error() }
+func (e invalidModuleError) Unwrap() error        { return e.err }
+func (e invalidModuleError) Is(target error) bool { return target == ErrInvalidModule }
+
+// checkModuleDir checks that the files in dir can be packed into a Go module zip,
+// returning an error naming the offending files, relative to dir, if not.
+func checkModuleDir(dir string) error {
+	cf, err := zip.CheckDir(dir)
+	return checkedFilesError(cf, err, func(p string) string {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return filepath.Base(p)
+		}
+		return filepath.ToSlash(rel)
+	})
 }
 
-func untar(dst string, r io.Reader) error {
-	gzr, err := gzip.NewReader(r)
+// metadataFileRe matches the files npm always includes in a package's
+// root, whatever its files field says.
+var metadataFileRe = regexp.MustCompile(`(?i)^(package\.json|(readme|license|licence|changelog|history|notice)(\..*)?|\.npmignore)$`)
+
+// checkSourceDir checks that the npm package extracted to dir contains
+// at least one file besides its metadata. Deprecated placeholders and
+// security holding packages often only have a package.json and a README.
+func checkSourceDir(dir string) error {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
+	return checkSourceFiles(files)
+}
 
-	for {
-		header, err := tr.Next()
-		switch {
-		case err == io.EOF:
+// checkSourceFiles is checkSourceDir for the slash separated
+// file paths files, e.g. package/index.js.
+func checkSourceFiles(files []string) error {
+	for _, f := range files {
+		if !isMetadataFile(f) {
 			return nil
-		case err != nil:
-			return err
-		case header == nil:
-			continue
 		}
+	}
+	return ErrNoSource
+}
+
+// isMetadataFile reports whether the file at the slash separated path p
+// is package metadata or docs rather than source, at any depth, e.g.
+// docs/README.md, or below a dot directory, e.g. .github/FUNDING.yml.
+func isMetadataFile(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	name := path.Base(p)
+	return metadataFileRe.MatchString(name) || strings.EqualFold(path.Ext(name), ".md")
+}
+
+// checkedFilesError returns an error naming the invalid files in cf, if any,
+// with their paths reported relative to the package by rel.
+func checkedFilesError(cf zip.CheckedFiles, err error, rel func(p string) string) error {
+	if err == nil {
+		return nil
+	}
+	if cf.SizeError != nil {
+		return fmt.Errorf("package is too large for a Go module: %s", cf.SizeError)
+	}
+	if len(cf.Invalid) == 0 {
+		return err
+	}
+	var invalid []string
+	for _, fe := range cf.Invalid {
+		invalid = append(invalid, fmt.Sprintf("%s: %s", rel(fe.Path), fe.Err))
+	}
+	return fmt.Errorf("package contains files not allowed in a Go module: %s", strings.Join(invalid, "; "))
+}
+
+// untar extracts the tarball in r to dst, removing dst on failure.
+func (c *Client) untar(ctx context.Context, dst string, r io.Reader) (err error) {
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dst)
+		}
+	}()
 
+	return c.readTarball(ctx, r, func(header *tar.Header, r io.Reader) error {
 		target := filepath.Join(dst, header.Name)
 
 		switch header.Typeflag {
@@ -290,18 +1846,189 @@ func untar(dst string, r io.Reader) error {
 				return err
 			}
 
-			if _, err := io.Copy(f, tr); err != nil {
+			if _, err := io.Copy(f, r); err != nil {
+				f.Close()
 				return err
 			}
 			f.Close()
 		}
+		return nil
+	})
+}
+
+// readTarball calls fn for each entry in the tarball in r, with the
+// top-level directory renamed to package, see packageEntryName.
+// Entries with invalid paths or colliding with others fail the read,
+// or are skipped as configured by ClientOptions.CaseCollisions.
+// Entries filtered out by ClientOptions.IncludeFiles and
+// ClientOptions.ExcludeFiles are skipped.
+func (c *Client) readTarball(ctx context.Context, r io.Reader, fn func(header *tar.Header, r io.Reader) error) error {
+	r, err := decompressTarball(r)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	collisions := make(caseCollisionChecker)
+
+	for {
+		header, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		case header == nil:
+			continue
+		}
+
+		header.Name = packageEntryName(header.Name)
+		if err := c.checkEntryPath(header.Name); err != nil {
+			return invalidModuleError{err}
+		}
+		if !c.keepEntry(header.Name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg {
+			if err := collisions.check(header.Name, header.Typeflag == tar.TypeDir); err != nil {
+				if c.opts.CaseCollisions == CaseCollisionSkip {
+					c.logf(ctx, "warning: skipping %s: %s", header.Name, err)
+					continue
+				}
+				return invalidModuleError{err}
+			}
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEntryPath checks the tarball entry path name against the
+// configured limits and that it stays within the extraction directory.
+func (c *Client) checkEntryPath(name string) error {
+	if len(name) > c.opts.MaxPathLength {
+		return fmt.Errorf("tarball entry %s: path length %d exceeds %d", shortPath(name), len(name), c.opts.MaxPathLength)
+	}
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		return fmt.Errorf("tarball entry %q: path outside of the package", name)
+	}
+	if depth := strings.Count(clean, "/") + 1; depth > c.opts.MaxPathDepth {
+		return fmt.Errorf("tarball entry %s: nesting depth %d exceeds %d", shortPath(name), depth, c.opts.MaxPathDepth)
+	}
+	return nil
+}
+
+// shortPath quotes p for error messages, truncated if long.
+func shortPath(p string) string {
+	if len(p) > 64 {
+		return strconv.Quote(p[:64]) + "..."
+	}
+	return strconv.Quote(p)
+}
+
+// packageEntryName returns the tarball entry name with its top-level
+// directory replaced by package, which npm ignores when installing.
+// Registry tarballs use package already, but older ones and tarballs
+// from elsewhere, e.g. GitHub, use the repository or package name.
+func packageEntryName(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	if i := strings.Index(name, "/"); i != -1 {
+		return "package" + name[i:]
+	}
+	return "package/" + name
+}
+
+// CaseCollisionPolicy decides what to do with tarball entries whose
+// paths differ only in case, which Go module zips don't allow.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionFail fails the build with an error naming both paths.
+	CaseCollisionFail CaseCollisionPolicy = iota
+
+	// CaseCollisionSkip keeps the first entry in the tarball and skips the others.
+	CaseCollisionSkip
+)
+
+// decompressTarball returns a reader of the tar archive in r, which is
+// either gzipped, as npm tarballs should be, or plain, as served by some
+// misconfigured mirrors.
+func decompressTarball(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(262)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for _, format := range []struct {
+		name  string
+		magic string
+	}{
+		{"bzip2", "BZh"},
+		{"xz", "\xfd7zXZ\x00"},
+		{"zstd", "\x28\xb5\x2f\xfd"},
+	} {
+		if bytes.HasPrefix(header, []byte(format.magic)) {
+			return nil, fmt.Errorf("unsupported tarball compression %s, expected gzip", format.name)
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("\x1f\x8b")):
+		return gzip.NewReader(br)
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return br, nil
 	}
+
+	return nil, errors.New("unrecognized tarball format, expected a gzipped tar archive")
 }
 
-func EscapePackage(p string) string {
-	return strings.ReplaceAll(p, "@", "___")
+// caseCollisionChecker maps case-folded paths to the first path seen.
+type caseCollisionChecker map[string]string
+
+// check records p and returns an error if it collides with a previously seen path.
+func (cc caseCollisionChecker) check(p string, isDir bool) error {
+	p = path.Clean(p)
+
+	// All parent directories must agree on case, too.
+	var dirs []string
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	if isDir {
+		dirs = append(dirs, p)
+	}
+
+	for _, dir := range dirs {
+		if seen, found := cc[strings.ToLower(dir)]; found && seen != dir {
+			return fmt.Errorf("case-insensitive path collision: %q and %q", seen, dir)
+		}
+	}
+
+	if !isDir {
+		if seen, found := cc[strings.ToLower(p)]; found && seen != p {
+			return fmt.Errorf("case-insensitive path collision: %q and %q", seen, p)
+		}
+		cc[strings.ToLower(p)] = p
+	}
+
+	for _, dir := range dirs {
+		cc[strings.ToLower(dir)] = dir
+	}
+
+	return nil
 }
 
-func UnEscapePackage(p string) string {
-	return strings.ReplaceAll(p, "___", "@")
+// PathMajor returns the major version suffix of the Go module path for v,
+// e.g. v2, or an empty string for v0 and v1.
+func PathMajor(v string) string {
+	major := semver.Major(v)
+	if major == "v1" || major == "v0" {
+		return ""
+	}
+	return major
 }
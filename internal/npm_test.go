@@ -1,40 +1,1770 @@
 package internal
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/bep/npmgoproxy/internal/npmtest"
 
 	qt "github.com/frankban/quicktest"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
 )
 
 func TestFetchPackage(t *testing.T) {
 	c := qt.New(t)
 
-	npmp, err := FetchPackage("alpinejs")
+	client := NewClient(ClientOptions{})
+	npmp, err := client.FetchPackage(context.Background(), "alpinejs")
 	c.Assert(err, qt.IsNil)
 
 	last, _ := npmp.Versions.ByVersion("v3.3.3")
 
 	c.Assert(last.Name, qt.Equals, "alpinejs")
 	c.Assert(last.Version, qt.Equals, "v3.3.3")
-	c.Assert(last.Dist, qt.DeepEquals, Dist{ShaSum: "966c94b6847f3d6840c5750e0b14caec82214e56", Tarball: "https://registry.npmjs.org/alpinejs/-/alpinejs-3.3.3.tgz"})
+	c.Assert(last.Dist.ShaSum, qt.Equals, "966c94b6847f3d6840c5750e0b14caec82214e56")
+	c.Assert(last.Dist.Integrity, qt.Matches, `sha512-.+`)
+	c.Assert(last.Dist.Tarball, qt.Equals, "https://registry.npmjs.org/alpinejs/-/alpinejs-3.3.3.tgz")
 	c.Assert(last.Dependencies, qt.DeepEquals, Dependencies{
 		{Name: "@vue/reactivity", VersionRange: "^3.0.2"},
 	})
 
 	name := fmt.Sprintf("%s-%s-%s.tgz", last.Name, last.Version, last.Dist.ShaSum)
 
-	tempDir, err := ioutil.TempDir("", "npmgop-test")
+	tempDir, err := os.MkdirTemp("", "npmgop-test")
 	c.Assert(err, qt.IsNil)
 	defer os.RemoveAll(tempDir)
 
 	tarFilename := filepath.Join(tempDir, name)
 
-	c.Assert(downloadTarball(last.Dist, tarFilename), qt.IsNil)
-	rc, err := repackTarballAsZip(tarFilename, last)
+	c.Assert(client.downloadTarball(context.Background(), last.Dist, tarFilename), qt.IsNil)
+	rc, err := client.repackTarballAsZip(context.Background(), tarFilename, last)
 	c.Assert(err, qt.IsNil)
 	c.Assert(rc.Close(), qt.IsNil)
 }
+
+func TestDecodeDependencyKinds(t *testing.T) {
+	c := qt.New(t)
+
+	var v Version
+	c.Assert(json.Unmarshal([]byte(`{
+		"name": "foo",
+		"version": "1.0.0",
+		"dependencies": {"b": "^1.0.0", "a": "^2.0.0"},
+		"optionalDependencies": {"c": "~1.2.0"},
+		"peerDependencies": {"d": ">=3"}
+	}`), &v), qt.IsNil)
+
+	c.Assert(v.Dependencies, qt.DeepEquals, Dependencies{{Name: "a", VersionRange: "^2.0.0"}, {Name: "b", VersionRange: "^1.0.0"}})
+	c.Assert(v.OptionalDependencies, qt.DeepEquals, Dependencies{{Name: "c", VersionRange: "~1.2.0"}})
+	c.Assert(v.PeerDependencies, qt.DeepEquals, Dependencies{{Name: "d", VersionRange: ">=3"}})
+}
+
+func TestDecodeBin(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		doc string
+		bin map[string]string
+	}{
+		{`{"name": "foo", "version": "1.0.0"}`, nil},
+		{`{"name": "foo", "version": "1.0.0", "bin": {"foo": "bin/foo.js", "foo-server": "bin/server.js"}}`, map[string]string{"foo": "bin/foo.js", "foo-server": "bin/server.js"}},
+		{`{"name": "@scope/foo", "version": "1.0.0", "bin": "cli.js"}`, map[string]string{"foo": "cli.js"}},
+	} {
+		var v Version
+		c.Assert(json.Unmarshal([]byte(test.doc), &v), qt.IsNil)
+		c.Assert(v.Bin, qt.DeepEquals, test.bin)
+		c.Assert(v.Version, qt.Equals, "1.0.0")
+	}
+}
+
+func TestDecodeRepository(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		doc        string
+		repository *Repository
+	}{
+		{`{"name": "foo", "version": "1.0.0"}`, nil},
+		{`{"name": "foo", "version": "1.0.0", "repository": "github:user/foo"}`, &Repository{URL: "github:user/foo"}},
+		{`{"name": "foo", "version": "1.0.0", "repository": {"type": "git", "url": "git+https://github.com/user/foo.git", "directory": "packages/foo"}}`, &Repository{Type: "git", URL: "git+https://github.com/user/foo.git", Directory: "packages/foo"}},
+		{`{"name": "foo", "version": "1.0.0", "repository": ["bogus"]}`, &Repository{}},
+	} {
+		var v Version
+		c.Assert(json.Unmarshal([]byte(test.doc), &v), qt.IsNil)
+		c.Assert(v.Repository, qt.DeepEquals, test.repository)
+		c.Assert(v.Version, qt.Equals, "1.0.0")
+	}
+
+	var p NpmPackage
+	c.Assert(json.Unmarshal([]byte(`{"name": "foo", "repository": "user/foo", "versions": {
+		"1.0.0": {"version": "1.0.0"},
+		"2.0.0": {"version": "2.0.0", "repository": {"type": "git", "url": "https://github.com/org/foo.git"}}
+	}}`), &p), qt.IsNil)
+	v1, _ := p.ByVersion("v1.0.0")
+	c.Assert(v1.Repository, qt.DeepEquals, &Repository{URL: "user/foo"})
+	v2, _ := p.ByVersion("v2.0.0")
+	c.Assert(v2.Repository, qt.DeepEquals, &Repository{Type: "git", URL: "https://github.com/org/foo.git"})
+}
+
+func TestDecodePackageFormats(t *testing.T) {
+	c := qt.New(t)
+
+	abbreviated := `{
+		"name": "foo",
+		"modified": "2021-03-01T10:00:00.000Z",
+		"dist-tags": {"latest": "1.1.0", "next": "2.0.0-beta.1"},
+		"versions": {
+			"1.0.0": {"name": "foo", "version": "1.0.0", "dist": {"shasum": "a", "tarball": "https://example.org/foo-1.0.0.tgz"}},
+			"1.1.0": {"name": "foo", "version": "1.1.0", "dependencies": {"bar": "^1.0.0"}, "dist": {"shasum": "b", "tarball": "https://example.org/foo-1.1.0.tgz"}},
+			"2.0.0-beta.1": {"name": "foo", "version": "2.0.0-beta.1", "dist": {"shasum": "c", "tarball": "https://example.org/foo-2.0.0-beta.1.tgz"}}
+		}
+	}`
+
+	full := `{
+		"_id": "foo",
+		"_rev": "3-abc",
+		"name": "foo",
+		"description": "Foo.",
+		"dist-tags": {"latest": "1.1.0", "next": "2.0.0-beta.1"},
+		"versions": {
+			"1.0.0": {"name": "foo", "version": "1.0.0", "description": "Foo.", "main": "index.js", "dist": {"shasum": "a", "tarball": "https://example.org/foo-1.0.0.tgz"}},
+			"1.1.0": {"name": "foo", "version": "1.1.0", "description": "Foo.", "dependencies": {"bar": "^1.0.0"}, "dist": {"shasum": "b", "tarball": "https://example.org/foo-1.1.0.tgz"}},
+			"2.0.0-beta.1": {"name": "foo", "version": "2.0.0-beta.1", "dist": {"shasum": "c", "tarball": "https://example.org/foo-2.0.0-beta.1.tgz"}}
+		},
+		"time": {
+			"created": "2021-01-01T10:00:00.000Z",
+			"modified": "2021-03-01T10:00:00.000Z",
+			"1.0.0": "2021-01-01T10:00:00.000Z",
+			"1.1.0": "2021-02-01T10:00:00.000Z",
+			"2.0.0-beta.1": "2021-03-01T10:00:00.000Z"
+		},
+		"readme": "# Foo"
+	}`
+
+	var pa, pf NpmPackage
+	c.Assert(json.Unmarshal([]byte(abbreviated), &pa), qt.IsNil)
+	c.Assert(json.Unmarshal([]byte(full), &pf), qt.IsNil)
+
+	modified := time.Date(2021, time.March, 1, 10, 0, 0, 0, time.UTC)
+	c.Assert(pa.Time.Modified.Equal(modified), qt.IsTrue)
+	c.Assert(pf.Time.Modified.Equal(modified), qt.IsTrue)
+	c.Assert(pf.Time.Versions, qt.HasLen, 3)
+	c.Assert(pa.Time.Versions, qt.HasLen, 0)
+
+	c.Assert(pa.Name, qt.Equals, pf.Name)
+	c.Assert(pa.DistTags, qt.DeepEquals, pf.DistTags)
+	c.Assert(pa.Versions, qt.DeepEquals, pf.Versions)
+	c.Assert(pa.Versions, qt.HasLen, 3)
+	c.Assert(pa.Versions[1].Dependencies, qt.DeepEquals, Dependencies{{Name: "bar", VersionRange: "^1.0.0"}})
+}
+
+func TestDecodeVersionNames(t *testing.T) {
+	c := qt.New(t)
+
+	var p NpmPackage
+	c.Assert(json.Unmarshal([]byte(`{
+		"name": "@scope/foo",
+		"dist-tags": {"latest": "1.1.0"},
+		"versions": {
+			"1.0.0": {"version": "1.0.0"},
+			"1.1.0": {"version": "1.1.0"}
+		}
+	}`), &p), qt.IsNil)
+	c.Assert(p.Versions, qt.HasLen, 2)
+	for _, v := range p.Versions {
+		c.Assert(v.Name, qt.Equals, "@scope/foo")
+	}
+}
+
+func TestDecodeVersionTypes(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		doc   string
+		types string
+	}{
+		{`{"version": "1.0.0"}`, ""},
+		{`{"version": "1.0.0", "types": "dist/index.d.ts"}`, "dist/index.d.ts"},
+		{`{"version": "1.0.0", "typings": "index.d.ts"}`, "index.d.ts"},
+		{`{"version": "1.0.0", "types": "types.d.ts", "typings": "typings.d.ts"}`, "types.d.ts"},
+		{`{"version": "1.0.0", "types": ["index.d.ts"], "typings": "index.d.ts"}`, "index.d.ts"},
+		{`{"version": "1.0.0", "types": {"path": "index.d.ts"}}`, ""},
+	} {
+		var v Version
+		c.Assert(json.Unmarshal([]byte(test.doc), &v), qt.IsNil, qt.Commentf(test.doc))
+		c.Assert(v.Types, qt.Equals, test.types, qt.Commentf(test.doc))
+	}
+}
+
+func TestFullMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	var accept string
+	registry.OnRequest = func(req *http.Request) {
+		accept = req.Header.Get("Accept")
+	}
+
+	_, err := NewClient(ClientOptions{Registry: registry.URL}).FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(accept, qt.Contains, "application/vnd.npm.install-v1+json")
+
+	p, err := NewClient(ClientOptions{Registry: registry.URL, FullMetadata: true}).FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(accept, qt.Equals, "application/json")
+	c.Assert(p.Time.Versions["v1.0.0"].IsZero(), qt.IsFalse)
+}
+
+func TestUnpublished(t *testing.T) {
+	c := qt.New(t)
+
+	var p NpmPackage
+	c.Assert(json.Unmarshal([]byte(`{
+		"name": "foo",
+		"versions": {"1.0.0": {"name": "foo", "version": "1.0.0"}},
+		"time": {
+			"created": "2021-01-01T00:00:00.000Z",
+			"modified": "2021-01-03T00:00:00.000Z",
+			"1.0.0": "2021-01-01T00:00:00.000Z",
+			"1.1.0": "2021-01-02T00:00:00.000Z"
+		}
+	}`), &p), qt.IsNil)
+
+	c.Assert(p.Time.Versions, qt.HasLen, 2)
+	c.Assert(p.IsUnpublished("v1.0.0"), qt.IsFalse)
+	c.Assert(p.IsUnpublished("v1.1.0"), qt.IsTrue)
+	c.Assert(p.IsUnpublished("v2.0.0"), qt.IsFalse)
+
+	c.Assert(json.Unmarshal([]byte(`{
+		"name": "bar",
+		"time": {
+			"created": "2021-01-01T00:00:00.000Z",
+			"modified": "2021-01-03T00:00:00.000Z",
+			"unpublished": {"time": "2021-01-03T00:00:00.000Z", "versions": ["1.0.0"]}
+		}
+	}`), &p), qt.IsNil)
+	c.Assert(p.IsUnpublished("v1.0.0"), qt.IsTrue)
+}
+
+func TestVerification(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	// Simulate a mirror that has recompressed the tarball.
+	registry.UpdateVersion("foo", "1.0.0", func(v map[string]interface{}) {
+		v["dist"].(map[string]interface{})["shasum"] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	})
+	registry.AddVersion("bar", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.UpdateVersion("bar", "1.0.0", func(v map[string]interface{}) {
+		dist := v["dist"].(map[string]interface{})
+		delete(dist, "shasum")
+		delete(dist, "integrity")
+	})
+
+	build := func(policy Verification, pkg string) error {
+		client := NewClient(ClientOptions{Registry: registry.URL, Verification: policy})
+		v, err := client.FetchPackageVersion(context.Background(), pkg, "v1.0.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+
+	c.Assert(build(VerifyPreferIntegrity, "foo"), qt.IsNil)
+	c.Assert(build(VerifySkipOnMissing, "foo"), qt.IsNil)
+	c.Assert(build(VerifyStrict, "foo"), qt.ErrorMatches, ".*shasum mismatch")
+	c.Assert(errors.Is(build(VerifyStrict, "foo"), ErrShasumMismatch), qt.IsTrue)
+
+	c.Assert(build(VerifyPreferIntegrity, "bar"), qt.ErrorMatches, ".*missing shasum and integrity")
+	c.Assert(build(VerifyStrict, "bar"), qt.ErrorMatches, ".*missing shasum and integrity")
+	c.Assert(build(VerifySkipOnMissing, "bar"), qt.IsNil)
+	c.Assert(errors.Is(build(VerifyStrict, "bar"), ErrMissingChecksum), qt.IsTrue)
+
+	registry.AddVersion("baz", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.UpdateVersion("baz", "1.0.0", func(v map[string]interface{}) {
+		v["dist"].(map[string]interface{})["integrity"] = "sha512-" + strings.Repeat("A", 86) + "=="
+	})
+	err := build(VerifyPreferIntegrity, "baz")
+	c.Assert(err, qt.ErrorMatches, ".*integrity mismatch: sha512")
+	c.Assert(errors.Is(err, ErrIntegrityMismatch), qt.IsTrue)
+}
+
+func TestVerificationChecksums(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	for _, pkg := range []string{"shasum-only", "integrity-only", "both", "neither"} {
+		registry.AddVersion(pkg, "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	}
+	registry.UpdateVersion("shasum-only", "1.0.0", func(v map[string]interface{}) {
+		delete(v["dist"].(map[string]interface{}), "integrity")
+	})
+	registry.UpdateVersion("integrity-only", "1.0.0", func(v map[string]interface{}) {
+		delete(v["dist"].(map[string]interface{}), "shasum")
+	})
+	registry.UpdateVersion("neither", "1.0.0", func(v map[string]interface{}) {
+		dist := v["dist"].(map[string]interface{})
+		delete(dist, "shasum")
+		delete(dist, "integrity")
+	})
+
+	tarball := npmtest.Tarball(map[string]string{"package.json": `{}`})
+
+	for _, test := range []struct {
+		policy   Verification
+		pkg      string
+		check    string
+		fallback bool
+		err      error
+	}{
+		{VerifyPreferIntegrity, "shasum-only", "shasum", true, nil},
+		{VerifyPreferIntegrity, "integrity-only", "integrity sha512", false, nil},
+		{VerifyPreferIntegrity, "both", "integrity sha512", false, nil},
+		{VerifyPreferIntegrity, "neither", "", false, ErrMissingChecksum},
+		{VerifyStrict, "shasum-only", "shasum", true, nil},
+		{VerifyStrict, "integrity-only", "integrity sha512", true, nil},
+		{VerifyStrict, "both", "shasum+integrity sha512", false, nil},
+		{VerifyStrict, "neither", "", false, ErrMissingChecksum},
+		{VerifySkipOnMissing, "shasum-only", "shasum", true, nil},
+		{VerifySkipOnMissing, "integrity-only", "integrity sha512", false, nil},
+		{VerifySkipOnMissing, "both", "integrity sha512", false, nil},
+		{VerifySkipOnMissing, "neither", "none", true, nil},
+	} {
+		c.Run(fmt.Sprintf("%s/%s", test.policy, test.pkg), func(c *qt.C) {
+			var buf bytes.Buffer
+			client := NewClient(ClientOptions{Registry: registry.URL, Verification: test.policy, Logger: log.New(&buf, "", 0)})
+			v, err := client.FetchPackageVersion(context.Background(), test.pkg, "v1.0.0")
+			c.Assert(err, qt.IsNil)
+
+			verifier := newTarballVerifier(v.Dist)
+			verifier.Write(tarball)
+			check, fallback, err := verifier.verify(test.policy)
+			if test.err != nil {
+				c.Assert(errors.Is(err, test.err), qt.IsTrue)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+			c.Assert(check, qt.Equals, test.check)
+			c.Assert(fallback, qt.Equals, test.fallback)
+
+			f, err := client.CreateZipFromVersion(context.Background(), v)
+			if test.err != nil {
+				c.Assert(errors.Is(err, test.err), qt.IsTrue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			f.Close()
+
+			// Only the fallbacks are logged.
+			tarballURL := registry.URL + npmtest.TarballPath(test.pkg, "1.0.0")
+			switch {
+			case test.check == "none":
+				c.Assert(buf.String(), qt.Contains, "warning: "+tarballURL+" has no shasum or integrity")
+			case test.fallback:
+				c.Assert(buf.String(), qt.Contains, "verified "+tarballURL+" using "+test.check+" only")
+			default:
+				c.Assert(buf.String(), qt.Not(qt.Contains), "verified")
+			}
+		})
+	}
+}
+
+func TestParseIntegrity(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(parseIntegrity(""), qt.IsNil)
+	c.Assert(parseIntegrity("md5-AAAA"), qt.IsNil)
+	c.Assert(parseIntegrity("sha1-2jmj7l5rSw0yVb/vlWAYkK/YBwk= sha512-z4PhNX7vuL3xVChQ1m2AB9Yg5AULVxXcg/SpIdNs6c5H0NE8XYXysP+DGNKHfuwvY7kxvUdBeoGlODJ6+SfaPg==").alg, qt.Equals, "sha512")
+}
+
+func TestFetchPackageVersionSingleVersionEndpoint(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("@scope/foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	client := NewClient(ClientOptions{Registry: registry.URL, MetadataTTL: time.Hour})
+
+	v, err := client.FetchPackageVersion(context.Background(), "@scope/foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(v.Name, qt.Equals, "@scope/foo")
+	c.Assert(v.Version, qt.Equals, "v1.0.0")
+	_, err = client.FetchPackageVersion(context.Background(), "@scope/foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(registry.Hits("/@scope/foo/1.0.0"), qt.Equals, 1)
+	c.Assert(registry.Hits("/@scope/foo"), qt.Equals, 0)
+
+	_, err = client.FetchPackageVersion(context.Background(), "@scope/foo", "v2.0.0")
+	c.Assert(err, qt.ErrorMatches, `version "v2.0.0" of package "@scope/foo": version not found`)
+	c.Assert(registry.Hits("/@scope/foo"), qt.Equals, 1)
+}
+
+func TestFetchPackageVersionDistTag(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.AddVersion("foo", "2.0.0-beta.1", map[string]string{"package.json": `{}`}, nil)
+	registry.SetDistTag("foo", "latest", "1.0.0")
+	registry.SetDistTag("foo", "beta", "2.0.0-beta.1")
+
+	client := NewClient(ClientOptions{Registry: registry.URL})
+
+	for _, test := range []struct {
+		version string
+		want    string
+	}{
+		{"", "v1.0.0"},
+		{"latest", "v1.0.0"},
+		{"beta", "v2.0.0-beta.1"},
+	} {
+		v, err := client.FetchPackageVersion(context.Background(), "foo", test.version)
+		c.Assert(err, qt.IsNil, qt.Commentf(test.version))
+		c.Assert(v.Version, qt.Equals, test.want, qt.Commentf(test.version))
+	}
+
+	_, err := client.FetchPackageVersion(context.Background(), "foo", "next")
+	c.Assert(err, qt.ErrorMatches, `dist-tag "next" of package "foo": version not found`)
+	c.Assert(errors.Is(err, ErrVersionNotFound), qt.IsTrue)
+}
+
+func TestCreateZipInvalidFilename(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`, "lib/aux.js": "x"}, nil)
+
+	client := NewClient(ClientOptions{Registry: registry.URL})
+	v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	_, err = client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.ErrorMatches, `package contains files not allowed in a Go module: package/lib/aux.js: .*`)
+	c.Assert(err.Error(), qt.Not(qt.Contains), os.TempDir())
+}
+
+func TestUntarCaseCollisions(t *testing.T) {
+	c := qt.New(t)
+
+	tarball := npmtest.Tarball(map[string]string{
+		"README.md":    "upper",
+		"readme.md":    "lower",
+		"Lib/a.js":     "a",
+		"lib/b.js":     "b",
+		"src/index.js": "index",
+	})
+
+	dir := c.TempDir()
+	err := NewClient(ClientOptions{}).untar(context.Background(), dir, bytes.NewReader(tarball))
+	c.Assert(err, qt.ErrorMatches, `case-insensitive path collision: "package/Lib" and "package/lib"`)
+
+	dir = c.TempDir()
+	c.Assert(NewClient(ClientOptions{CaseCollisions: CaseCollisionSkip}).untar(context.Background(), dir, bytes.NewReader(tarball)), qt.IsNil)
+	cf, err := zip.CheckDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cf.Valid, qt.HasLen, 3)
+	b, err := os.ReadFile(filepath.Join(dir, "package", "README.md"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "upper")
+	_, err = os.Stat(filepath.Join(dir, "package", "lib"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestUntarDuplicateEntries(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, f := range []struct{ name, content string }{
+		{"package/package.json", `{}`},
+		{"package/index.js", "first"},
+		{"package/index.js", "second"},
+	} {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}), qt.IsNil)
+		_, err := tw.Write([]byte(f.content))
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(tw.Close(), qt.IsNil)
+	c.Assert(gzw.Close(), qt.IsNil)
+	tarball := buf.Bytes()
+
+	// Later entries overwrite earlier ones, on disk and in memory.
+	client := NewClient(ClientOptions{})
+	dir := c.TempDir()
+	c.Assert(client.untar(context.Background(), dir, bytes.NewReader(tarball)), qt.IsNil)
+	b, err := os.ReadFile(filepath.Join(dir, "package", "index.js"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "second")
+
+	version := Version{Name: "foo", Version: "v1.0.0"}
+	f, err := client.repackTarballInMemory(context.Background(), tarball, version)
+	c.Assert(err, qt.IsNil)
+	zb, err := io.ReadAll(f)
+	c.Assert(err, qt.IsNil)
+	zipFilename := filepath.Join(c.TempDir(), "foo.zip")
+	c.Assert(os.WriteFile(zipFilename, zb, 0o644), qt.IsNil)
+	dir = c.TempDir()
+	c.Assert(zip.Unzip(dir, module.Version{Path: VersionModulePath(client.opts.ModulePathBase, version.Name, version.Version), Version: version.Version}, zipFilename), qt.IsNil)
+	b, err = os.ReadFile(filepath.Join(dir, "package", "index.js"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "second")
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.AddVersion("bar", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+	registry.OnRequest = func(req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+
+	fetchConcurrently := func(limit int) int {
+		maxSeen = 0
+		client := NewClient(ClientOptions{Registry: registry.URL, MaxConcurrentRequests: limit})
+		var wg sync.WaitGroup
+		for _, pkg := range []string{"foo", "bar"} {
+			wg.Add(1)
+			go func(pkg string) {
+				defer wg.Done()
+				_, err := client.FetchPackage(context.Background(), pkg)
+				c.Check(err, qt.IsNil)
+			}(pkg)
+		}
+		wg.Wait()
+		return maxSeen
+	}
+
+	c.Assert(fetchConcurrently(1), qt.Equals, 1)
+	c.Assert(fetchConcurrently(2), qt.Equals, 2)
+
+	// A request waiting for a slot gives up when its context is done.
+	client := NewClient(ClientOptions{Registry: registry.URL, MaxConcurrentRequests: 1})
+	client.requests <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.FetchPackage(ctx, "foo")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+}
+
+func TestReconfigure(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.AddVersion("bar", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	other := npmtest.NewRegistry()
+	defer other.Close()
+	other.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	opts := ClientOptions{Registry: registry.URL, MaxConcurrentRequests: 1, MetadataTTL: time.Hour}
+	client := NewClient(opts)
+	_, err := client.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+
+	// New auth tokens keep the metadata cache.
+	opts.AuthTokens = map[string]string{"example.org": "secret"}
+	reconfigured := client.Reconfigure(opts)
+	_, err = reconfigured.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(registry.Hits("/foo"), qt.Equals, 1)
+
+	// The limit of concurrent requests is shared with the old client.
+	client.requests <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = reconfigured.FetchPackage(ctx, "bar")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	<-client.requests
+
+	// Another registry drops it.
+	opts.Registry = other.URL
+	_, err = reconfigured.Reconfigure(opts).FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(other.Hits("/foo"), qt.Equals, 1)
+}
+
+func TestTimeouts(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("slow", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.OnRequest = func(req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/slow") || strings.HasSuffix(req.URL.Path, ".tgz") {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+
+	client := NewClient(ClientOptions{Registry: registry.URL, MetadataTimeout: 20 * time.Millisecond})
+	_, err := client.FetchPackage(context.Background(), "slow")
+	c.Assert(errors.Is(err, ErrRegistryUnavailable), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `upstream registry unavailable: timed out after 20ms: .*`)
+
+	// The tarball downloads have their own timeout.
+	v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	f.Close()
+
+	client = NewClient(ClientOptions{Registry: registry.URL, TarballTimeout: 20 * time.Millisecond})
+	_, err = client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(errors.Is(err, ErrRegistryUnavailable), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `.*timed out after 20ms: .*`)
+
+	// A request context done first is reported as such.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = NewClient(ClientOptions{Registry: registry.URL}).FetchPackage(ctx, "slow")
+	c.Assert(err, qt.Equals, context.DeadlineExceeded)
+}
+
+func TestUserAgent(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	var mu sync.Mutex
+	userAgents := make(map[string]string)
+	registry.OnRequest = func(req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		userAgents[req.URL.Path] = req.UserAgent()
+	}
+
+	fetch := func(opts ClientOptions) {
+		opts.Registry = registry.URL
+		client := NewClient(opts)
+		v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		c.Assert(err, qt.IsNil)
+		f.Close()
+	}
+
+	tarballPath := npmtest.TarballPath("foo", "1.0.0")
+
+	fetch(ClientOptions{})
+	c.Assert(userAgents["/foo/1.0.0"], qt.Matches, `npmgoproxy/.+`)
+	c.Assert(userAgents[tarballPath], qt.Equals, userAgents["/foo/1.0.0"])
+
+	fetch(ClientOptions{UserAgent: "myproxy/1.0", Contact: "ops@example.org"})
+	c.Assert(userAgents["/foo/1.0.0"], qt.Equals, "myproxy/1.0 (+ops@example.org)")
+	c.Assert(userAgents[tarballPath], qt.Equals, "myproxy/1.0 (+ops@example.org)")
+}
+
+func TestFallbackRegistries(t *testing.T) {
+	c := qt.New(t)
+
+	secondary := npmtest.NewRegistry()
+	defer secondary.Close()
+	secondary.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	client := NewClient(ClientOptions{Registry: unreachable.URL, FallbackRegistries: []string{failing.URL, secondary.URL}})
+	p, err := client.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Name, qt.Equals, "foo")
+	c.Assert(secondary.Hits("/foo"), qt.Equals, 1)
+
+	v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	f.Close()
+
+	// A 404 from the primary is an answer.
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	client = NewClient(ClientOptions{Registry: notFound.URL, FallbackRegistries: []string{secondary.URL}})
+	_, err = client.FetchPackage(context.Background(), "foo")
+	c.Assert(errors.Is(err, ErrPackageNotFound), qt.IsTrue)
+	c.Assert(secondary.Hits("/foo"), qt.Equals, 1)
+
+	// All registries failing.
+	client = NewClient(ClientOptions{Registry: unreachable.URL, FallbackRegistries: []string{failing.URL}})
+	_, err = client.FetchPackage(context.Background(), "foo")
+	c.Assert(errors.Is(err, ErrRegistryUnavailable), qt.IsTrue)
+}
+
+func TestRegistryOverrides(t *testing.T) {
+	c := qt.New(t)
+
+	public := npmtest.NewRegistry()
+	defer public.Close()
+	public.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	public.AddVersion("@mycorp/bar", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	private := npmtest.NewRegistry()
+	defer private.Close()
+	private.AddVersion("@mycorp/bar", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	var mu sync.Mutex
+	var auth []string
+	private.OnRequest = func(req *http.Request) {
+		mu.Lock()
+		auth = append(auth, req.Header.Get("Authorization"))
+		mu.Unlock()
+	}
+
+	client := NewClient(ClientOptions{
+		Registry: public.URL,
+		RegistryOverrides: []RegistryOverride{
+			{Prefix: "@mycorp/", Registry: private.URL + "/", AuthToken: "secret"},
+		},
+	})
+
+	_, err := client.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(public.Hits("/foo"), qt.Equals, 1)
+
+	v, err := client.FetchPackageVersion(context.Background(), "@mycorp/bar", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	f.Close()
+
+	c.Assert(private.Hits(npmtest.TarballPath("@mycorp/bar", "1.0.0")), qt.Equals, 1)
+	c.Assert(public.Hits("/@mycorp/bar"), qt.Equals, 0)
+	c.Assert(public.Hits("/@mycorp/bar/1.0.0"), qt.Equals, 0)
+	c.Assert(public.Hits(npmtest.TarballPath("@mycorp/bar", "1.0.0")), qt.Equals, 0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(len(auth) >= 2, qt.IsTrue)
+	for _, a := range auth {
+		c.Assert(a, qt.Equals, "Bearer secret")
+	}
+}
+
+func TestRelativeTarballURL(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	for pkg, tarball := range map[string]string{
+		"foo":        npmtest.TarballPath("foo", "1.0.0"),
+		"bar":        strings.TrimPrefix(npmtest.TarballPath("bar", "1.0.0"), "/"),
+		"@scope/baz": npmtest.TarballPath("@scope/baz", "1.0.0"),
+	} {
+		tarball := tarball
+		registry.AddVersion(pkg, "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+		registry.UpdateVersion(pkg, "1.0.0", func(v map[string]interface{}) {
+			v["dist"].(map[string]interface{})["tarball"] = tarball
+		})
+	}
+
+	for _, pkg := range []string{"foo", "bar", "@scope/baz"} {
+		client := NewClient(ClientOptions{Registry: registry.URL + "/"})
+
+		// Both the per-version and the package documents.
+		v, err := client.FetchPackageVersion(context.Background(), pkg, "v1.0.0")
+		c.Assert(err, qt.IsNil)
+		c.Assert(v.Dist.Tarball, qt.Equals, registry.URL+npmtest.TarballPath(pkg, "1.0.0"))
+		p, err := client.FetchPackage(context.Background(), pkg)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.Versions[0].Dist.Tarball, qt.Equals, v.Dist.Tarball)
+
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		c.Assert(err, qt.IsNil, qt.Commentf(pkg))
+		f.Close()
+		c.Assert(registry.Hits(npmtest.TarballPath(pkg, "1.0.0")), qt.Equals, 1)
+	}
+}
+
+func TestTarballURLs(t *testing.T) {
+	c := qt.New(t)
+
+	client := NewClient(ClientOptions{Registry: "https://a.example.org/", FallbackRegistries: []string{"https://b.example.org/npm"}})
+	c.Assert(client.tarballURLs("https://a.example.org/foo/-/foo-1.0.0.tgz"), qt.DeepEquals, []string{
+		"https://a.example.org/foo/-/foo-1.0.0.tgz",
+		"https://b.example.org/npm/foo/-/foo-1.0.0.tgz",
+	})
+	c.Assert(client.tarballURLs("https://b.example.org/npm/foo/-/foo-1.0.0.tgz"), qt.DeepEquals, []string{
+		"https://b.example.org/npm/foo/-/foo-1.0.0.tgz",
+		"https://a.example.org/foo/-/foo-1.0.0.tgz",
+	})
+	c.Assert(client.tarballURLs("https://cdn.example.org/foo-1.0.0.tgz"), qt.DeepEquals, []string{"https://cdn.example.org/foo-1.0.0.tgz"})
+}
+
+func TestMaxTarballSize(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 2048))
+	}))
+	defer srv.Close()
+
+	dist := Dist{Tarball: srv.URL + "/foo/-/foo-1.0.0.tgz"}
+	target := filepath.Join(c.TempDir(), "foo.tgz")
+
+	client := NewClient(ClientOptions{Registry: srv.URL, MaxTarballSize: 1024, Verification: VerifySkipOnMissing})
+	err := client.downloadTarball(context.Background(), dist, target)
+	c.Assert(errors.Is(err, ErrTarballTooLarge), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `.*tarball too large: exceeds 1024 bytes`)
+	_, err = os.Stat(target)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	client = NewClient(ClientOptions{Registry: srv.URL, MaxTarballSize: 2048, Verification: VerifySkipOnMissing})
+	c.Assert(client.downloadTarball(context.Background(), dist, target), qt.IsNil)
+}
+
+func TestVersions(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	for _, v := range []string{"1.10.0", "2.0.0-beta.1", "1.2.0", "2.0.0"} {
+		registry.AddVersion("foo", v, map[string]string{"package.json": `{}`}, nil)
+	}
+
+	client := NewClient(ClientOptions{Registry: registry.URL, FullMetadata: true})
+	versions, err := client.Versions(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(versions, qt.HasLen, 4)
+
+	var got []string
+	for _, v := range versions {
+		got = append(got, fmt.Sprintf("%s %t", v.Version, v.Prerelease))
+		c.Assert(v.Time.IsZero(), qt.IsFalse)
+	}
+	c.Assert(got, qt.DeepEquals, []string{"v1.2.0 false", "v1.10.0 false", "v2.0.0-beta.1 true", "v2.0.0 false"})
+}
+
+func TestRedirectAuth(t *testing.T) {
+	c := qt.New(t)
+
+	tarball := npmtest.Tarball(map[string]string{"package.json": `{}`})
+
+	var gotAuth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Write(tarball)
+	}))
+	defer cdn.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer registry.Close()
+
+	host := func(s *httptest.Server) string {
+		return strings.TrimPrefix(s.URL, "http://")
+	}
+
+	dist := Dist{Tarball: registry.URL + "/foo/-/foo-1.0.0.tgz"}
+	target := filepath.Join(c.TempDir(), "foo.tgz")
+
+	client := NewClient(ClientOptions{
+		Registry:     registry.URL,
+		Verification: VerifySkipOnMissing,
+		AuthTokens:   map[string]string{host(registry): "registry-token", host(cdn): "cdn-token"},
+	})
+	c.Assert(client.downloadTarball(context.Background(), dist, target), qt.IsNil)
+	c.Assert(gotAuth, qt.Equals, "Bearer cdn-token")
+
+	client = NewClient(ClientOptions{
+		Registry:     registry.URL,
+		Verification: VerifySkipOnMissing,
+		AuthTokens:   map[string]string{host(registry): "registry-token"},
+	})
+	gotAuth = ""
+	err := client.downloadTarball(context.Background(), dist, target)
+	c.Assert(err, qt.ErrorMatches, `.*would drop authentication, no auth token configured for `+host(cdn))
+	c.Assert(gotAuth, qt.Equals, "")
+
+	// Unauthenticated requests follow redirects as usual.
+	client = NewClient(ClientOptions{Registry: registry.URL, Verification: VerifySkipOnMissing})
+	c.Assert(client.downloadTarball(context.Background(), dist, target), qt.IsNil)
+	c.Assert(gotAuth, qt.Equals, "")
+}
+
+func TestCreateZipUppercaseName(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("JSONStream", "1.3.5", map[string]string{"package.json": `{}`}, nil)
+
+	client := NewClient(ClientOptions{Registry: registry.URL})
+	v, err := client.FetchPackageVersion(context.Background(), "JSONStream", "v1.3.5")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+
+	cf, err := zip.CheckZip(module.Version{Path: "gohugo.io/npmjs/JSONStream", Version: "v1.3.5"}, f.Name())
+	c.Assert(err, qt.IsNil)
+	c.Assert(cf.Err(), qt.IsNil)
+	c.Assert(cf.Valid, qt.DeepEquals, []string{"gohugo.io/npmjs/JSONStream@v1.3.5/package/package.json"})
+}
+
+func TestRequireSource(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("placeholder", "0.0.1-security", map[string]string{"package.json": `{}`, "README.md": "Security holding package."}, nil)
+	registry.AddVersion("lib", "1.0.0", map[string]string{"package.json": `{}`, "README.md": "x", "lib/index.js": "x"}, nil)
+	registry.AddVersion("root", "1.0.0", map[string]string{"package.json": `{}`, "LICENSE": "x", "index.js": "x"}, nil)
+	registry.AddVersion("docs", "1.0.0", map[string]string{"package.json": `{}`, "docs/README.md": "x", "docs/guide.MD": "x", ".github/FUNDING.yml": "x"}, nil)
+
+	createZip := func(client *Client, pkg, version string) error {
+		v, err := client.FetchPackageVersion(context.Background(), pkg, version)
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+
+	client := NewClient(ClientOptions{Registry: registry.URL})
+	c.Assert(createZip(client, "placeholder", "v0.0.1-security"), qt.IsNil)
+
+	client = NewClient(ClientOptions{Registry: registry.URL, RequireSource: true})
+	err := createZip(client, "placeholder", "v0.0.1-security")
+	c.Assert(errors.Is(err, ErrNoSource), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `placeholder@v0.0.1-security: package contains no files besides package.json, README and LICENSE, it may be a placeholder`)
+	c.Assert(createZip(client, "lib", "v1.0.0"), qt.IsNil)
+	c.Assert(createZip(client, "root", "v1.0.0"), qt.IsNil)
+	c.Assert(errors.Is(createZip(client, "docs", "v1.0.0"), ErrNoSource), qt.IsTrue)
+}
+
+func TestTransport(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	transport := &recordingTransport{}
+	client := NewClient(ClientOptions{Registry: registry.URL, Transport: transport})
+
+	_, err := client.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	f.Close()
+
+	c.Assert(transport.paths, qt.DeepEquals, []string{"/foo", "/foo/1.0.0", npmtest.TarballPath("foo", "1.0.0")})
+}
+
+type recordingTransport struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.paths = append(t.paths, req.URL.Path)
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGzipMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	for i := 0; i < 50; i++ {
+		registry.AddVersion("foo", fmt.Sprintf("1.%d.0", i), map[string]string{"package.json": `{}`}, nil)
+	}
+
+	var acceptEncoding string
+	registry.OnRequest = func(req *http.Request) {
+		acceptEncoding = req.Header.Get("Accept-Encoding")
+	}
+
+	fetch := func(transport http.RoundTripper) int64 {
+		sent := registry.Sent()
+		p, err := NewClient(ClientOptions{Registry: registry.URL, Transport: transport}).FetchPackage(context.Background(), "foo")
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.Versions, qt.HasLen, 50)
+		c.Assert(p.Versions[49].Dist.Tarball, qt.Equals, registry.URL+npmtest.TarballPath("foo", "1.49.0"))
+		return registry.Sent() - sent
+	}
+
+	plain := fetch(nil)
+	c.Assert(acceptEncoding, qt.Equals, "gzip")
+	registry.Gzip = true
+	gzipped := fetch(nil)
+	c.Assert(gzipped < plain/4, qt.IsTrue, qt.Commentf("sent %d bytes gzipped, %d plain", gzipped, plain))
+
+	// A transport setting Accept-Encoding itself gets the body still gzipped.
+	c.Assert(fetch(gzipTransport{}), qt.Equals, gzipped)
+	v, err := NewClient(ClientOptions{Registry: registry.URL, Transport: gzipTransport{}}).FetchPackageVersion(context.Background(), "foo", "v1.2.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(v.Version, qt.Equals, "v1.2.0")
+}
+
+type gzipTransport struct{}
+
+func (gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept-Encoding", "gzip")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUntarCompression(t *testing.T) {
+	c := qt.New(t)
+
+	gzipped := npmtest.Tarball(map[string]string{"package.json": `{}`, "lib/index.js": "x"})
+	gzr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	c.Assert(err, qt.IsNil)
+	plain, err := io.ReadAll(gzr)
+	c.Assert(err, qt.IsNil)
+
+	for _, tarball := range [][]byte{gzipped, plain} {
+		dir := c.TempDir()
+		c.Assert(NewClient(ClientOptions{}).untar(context.Background(), dir, bytes.NewReader(tarball)), qt.IsNil)
+		b, err := os.ReadFile(filepath.Join(dir, "package", "lib", "index.js"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, "x")
+	}
+
+	for _, test := range []struct {
+		tarball []byte
+		err     string
+	}{
+		{[]byte("\xfd7zXZ\x00compressed"), `unsupported tarball compression xz, expected gzip`},
+		{[]byte("BZh91AY&SY"), `unsupported tarball compression bzip2, expected gzip`},
+		{[]byte("<html>Not found</html>"), `unrecognized tarball format, expected a gzipped tar archive`},
+	} {
+		err := NewClient(ClientOptions{}).untar(context.Background(), c.TempDir(), bytes.NewReader(test.tarball))
+		c.Assert(err, qt.ErrorMatches, test.err)
+	}
+}
+
+func TestFetchPackageEmptyResponse(t *testing.T) {
+	c := qt.New(t)
+
+	body := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(ClientOptions{Registry: srv.URL}).FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.ErrorMatches, `package "foo": empty response from registry`)
+
+	body = `{"name": "foo", "versions": {`
+	_, err = NewClient(ClientOptions{Registry: srv.URL}).FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.ErrorMatches, `package "foo": failed to decode registry response: unexpected EOF`)
+}
+
+func TestRepackTarballAsZipDeterministic(t *testing.T) {
+	c := qt.New(t)
+
+	files := []struct{ name, content string }{
+		{"package/package.json", `{}`},
+		{"package/lib/a.js", "a"},
+		{"package/lib/b.js", "b"},
+		{"package/index.js", "index"},
+	}
+
+	// Writes the files to a tarball in the given order with the given mtime.
+	writeTarball := func(order []int, mtime time.Time) string {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gzw)
+		for _, i := range order {
+			f := files[i]
+			c.Assert(tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content)), ModTime: mtime, Typeflag: tar.TypeReg}), qt.IsNil)
+			_, err := tw.Write([]byte(f.content))
+			c.Assert(err, qt.IsNil)
+		}
+		c.Assert(tw.Close(), qt.IsNil)
+		c.Assert(gzw.Close(), qt.IsNil)
+		filename := filepath.Join(c.TempDir(), "foo.tgz")
+		c.Assert(os.WriteFile(filename, buf.Bytes(), 0o644), qt.IsNil)
+		return filename
+	}
+
+	version := Version{Name: "foo", Version: "v1.0.0"}
+	zipSum := func(tarFilename string) [sha256.Size]byte {
+		f, err := NewClient(ClientOptions{}).repackTarballAsZip(context.Background(), tarFilename, version)
+		c.Assert(err, qt.IsNil)
+		defer f.Close()
+		b, err := os.ReadFile(f.Name())
+		c.Assert(err, qt.IsNil)
+		return sha256.Sum256(b)
+	}
+
+	sum1 := zipSum(writeTarball([]int{0, 1, 2, 3}, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	sum2 := zipSum(writeTarball([]int{3, 2, 1, 0}, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)))
+	c.Assert(sum1, qt.Equals, sum2)
+}
+
+func TestURLPackageTarball(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		spec    string
+		tarball string
+	}{
+		{"github:bep/foo#v1.2.3", "https://codeload.github.com/bep/foo/tar.gz/v1.2.3"},
+		{"git+https://github.com/bep/foo.git#main", "https://codeload.github.com/bep/foo/tar.gz/main"},
+		{"https://github.com/bep/foo", "https://codeload.github.com/bep/foo/tar.gz/HEAD"},
+		{"https://example.org/foo-1.0.0.tgz", "https://example.org/foo-1.0.0.tgz"},
+	} {
+		tarball, err := urlPackageTarball(test.spec)
+		c.Assert(err, qt.IsNil)
+		c.Assert(tarball, qt.Equals, test.tarball)
+	}
+
+	for _, spec := range []string{"git+ssh://git@github.com/bep/foo.git", "gitlab:bep/foo", "file:../foo"} {
+		_, err := urlPackageTarball(spec)
+		c.Assert(err, qt.ErrorMatches, `unsupported URL package .*: only tarball URLs and GitHub git URLs are supported`)
+	}
+	_, err := urlPackageTarball("http://example.org/foo-1.0.0.tgz")
+	c.Assert(err, qt.ErrorMatches, `unsupported URL package .*: only https URLs are supported`)
+}
+
+func TestCheckURLPackageURL(t *testing.T) {
+	c := qt.New(t)
+
+	client := NewClient(ClientOptions{URLHosts: []string{"github.com", "example.org"}})
+	check := func(s string) error {
+		u, err := url.Parse(s)
+		c.Assert(err, qt.IsNil)
+		return client.checkURLPackageURL(u)
+	}
+
+	c.Assert(check("https://codeload.github.com/bep/foo/tar.gz/main"), qt.IsNil)
+	c.Assert(check("https://example.org/foo.tgz"), qt.IsNil)
+	c.Assert(check("https://evil.example.com/foo.tgz"), qt.ErrorMatches, `host evil.example.com is not allowed`)
+	c.Assert(check("http://example.org/foo.tgz"), qt.ErrorMatches, `http://example.org/foo.tgz: only https URLs are supported`)
+
+	client = NewClient(ClientOptions{URLHosts: []string{"example.org"}})
+	c.Assert(client.checkURLPackageURL(&url.URL{Scheme: "https", Host: "codeload.github.com"}), qt.ErrorMatches, `host codeload.github.com is not allowed`)
+}
+
+func TestUntarPathLimits(t *testing.T) {
+	c := qt.New(t)
+
+	untar := func(opts ClientOptions, files map[string]string) (string, error) {
+		dir := filepath.Join(c.TempDir(), "out")
+		c.Assert(os.Mkdir(dir, 0o755), qt.IsNil)
+		return dir, NewClient(opts).untar(context.Background(), dir, bytes.NewReader(npmtest.Tarball(files)))
+	}
+
+	files := map[string]string{
+		"index.js": "x",
+		strings.Repeat("a", 200) + "/" + strings.Repeat("b", 100) + ".js": "x",
+	}
+	dir, err := untar(ClientOptions{MaxPathLength: 256}, files)
+	c.Assert(err, qt.ErrorMatches, `tarball entry "package/aaa.*"\.\.\.: path length 312 exceeds 256`)
+	c.Assert(errors.Is(err, ErrInvalidModule), qt.IsTrue)
+	_, err = os.Stat(dir)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	_, err = untar(ClientOptions{}, files)
+	c.Assert(err, qt.IsNil)
+
+	files = map[string]string{
+		"index.js":                            "x",
+		strings.Repeat("d/", 10) + "index.js": "x",
+	}
+	dir, err = untar(ClientOptions{MaxPathDepth: 8}, files)
+	c.Assert(err, qt.ErrorMatches, `tarball entry "package/d/d/d/d/d/d/d/d/d/d/index.js": nesting depth 12 exceeds 8`)
+	_, err = os.Stat(dir)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	err = NewClient(ClientOptions{}).checkEntryPath("package/a/../../../evil.js")
+	c.Assert(err, qt.ErrorMatches, `tarball entry "package/a/../../../evil.js": path outside of the package`)
+}
+
+func TestWorkDir(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+
+	workDir := c.TempDir()
+	client := NewClient(ClientOptions{Registry: registry.URL, WorkDir: workDir})
+	v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+
+	c.Assert(strings.HasPrefix(f.Name(), workDir+string(filepath.Separator)), qt.IsTrue, qt.Commentf(f.Name()))
+	entries, err := os.ReadDir(workDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Name(), qt.Matches, `npmgop.*`)
+}
+
+func TestCreateZipInMemory(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x", "lib/a.js": "a", "lib.js": "l"}, nil)
+	registry.AddVersion("bad", "1.0.0", map[string]string{"package.json": `{}`, "con.js": "x"}, nil)
+	registry.AddVersion("placeholder", "1.0.0", map[string]string{"package.json": `{}`, "README.md": "x"}, nil)
+
+	build := func(opts ClientOptions, pkg string) ([]byte, error) {
+		opts.Registry = registry.URL
+		client := NewClient(opts)
+		v, err := client.FetchPackageVersion(context.Background(), pkg, "v1.0.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(f)
+	}
+
+	memWorkDir, diskWorkDir := c.TempDir(), c.TempDir()
+	inMemory, err := build(ClientOptions{MaxInMemorySize: 1 << 20, WorkDir: memWorkDir}, "foo")
+	c.Assert(err, qt.IsNil)
+	spilled, err := build(ClientOptions{MaxInMemorySize: 10, WorkDir: diskWorkDir}, "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(inMemory, qt.DeepEquals, spilled)
+
+	// Nothing is written to disk in memory; the spilled temp files are removed on Close.
+	for _, dir := range []string{memWorkDir, diskWorkDir} {
+		entries, err := os.ReadDir(dir)
+		c.Assert(err, qt.IsNil)
+		c.Assert(entries, qt.HasLen, 0)
+	}
+
+	_, err = build(ClientOptions{MaxInMemorySize: 1 << 20}, "bad")
+	c.Assert(errors.Is(err, ErrInvalidModule), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `package contains files not allowed in a Go module: package/con.js: .*`)
+
+	_, err = build(ClientOptions{MaxInMemorySize: 1 << 20, RequireSource: true}, "placeholder")
+	c.Assert(errors.Is(err, ErrNoSource), qt.IsTrue)
+}
+
+func TestDocGo(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("@scope/foo-bar", "1.2.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+	m := module.Version{Path: "gohugo.io/npmjs/___scope/foo-bar", Version: "v1.2.0"}
+
+	unzip := func(opts ClientOptions) string {
+		opts.Registry = registry.URL
+		client := NewClient(opts)
+		v, err := client.FetchPackageVersion(context.Background(), "@scope/foo-bar", "v1.2.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		c.Assert(err, qt.IsNil)
+		defer f.Close()
+		_, err = f.Seek(0, io.SeekStart)
+		c.Assert(err, qt.IsNil)
+		zipFilename := filepath.Join(c.TempDir(), "m.zip")
+		b, err := io.ReadAll(f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(os.WriteFile(zipFilename, b, 0o644), qt.IsNil)
+		dir := filepath.Join(c.TempDir(), "m")
+		c.Assert(zip.Unzip(dir, m, zipFilename), qt.IsNil)
+		return dir
+	}
+
+	for _, maxInMemorySize := range []int64{0, 1 << 20} {
+		dir := unzip(ClientOptions{DocGo: true, MaxInMemorySize: maxInMemorySize})
+		b, err := os.ReadFile(filepath.Join(dir, "doc.go"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, `// Package foobar is the npm package @scope/foo-bar 1.2.0 repacked as a Go module.
+//
+// It contains no Go code, the npm package files are in the package directory.
+package foobar
+`)
+		_, err = os.Stat(filepath.Join(dir, "package", "index.js"))
+		c.Assert(err, qt.IsNil)
+
+		dir = unzip(ClientOptions{MaxInMemorySize: maxInMemorySize})
+		_, err = os.Stat(filepath.Join(dir, "doc.go"))
+		c.Assert(os.IsNotExist(err), qt.IsTrue)
+	}
+
+	for name, want := range map[string]string{
+		"@vue/reactivity": "reactivity",
+		"lodash.merge":    "lodashmerge",
+		"3d-view":         "npm3dview",
+		"type":            "npmtype",
+		"@scope/-":        "npm",
+		"Vue":             "vue",
+	} {
+		c.Assert(goPackageName(name), qt.Equals, want, qt.Commentf(name))
+	}
+}
+
+func TestTransform(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.2.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+	m := module.Version{Path: "gohugo.io/npmjs/foo", Version: "v1.2.0"}
+
+	build := func(transform TransformFunc) (*zip.CheckedFiles, error) {
+		workDir := c.TempDir()
+		client := NewClient(ClientOptions{Registry: registry.URL, WorkDir: workDir, MaxInMemorySize: 1 << 20, Transform: transform})
+		v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.2.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		if err != nil {
+			// The extracted files are removed.
+			entries, rerr := os.ReadDir(workDir)
+			c.Assert(rerr, qt.IsNil)
+			c.Assert(entries, qt.HasLen, 0)
+			return nil, err
+		}
+		defer f.Close()
+		cf, err := zip.CheckZip(m, f.Name())
+		c.Assert(err, qt.IsNil)
+		return &cf, nil
+	}
+
+	var got Version
+	cf, err := build(func(ctx context.Context, v Version, dir string) error {
+		got = v
+		return os.WriteFile(filepath.Join(dir, "package", "LICENSE"), []byte("MIT"), 0o644)
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got.Name, qt.Equals, "foo")
+	c.Assert(got.Version, qt.Equals, "v1.2.0")
+	c.Assert(cf.Valid, qt.Contains, m.String()+"/package/LICENSE")
+	c.Assert(cf.Valid, qt.Contains, m.String()+"/package/index.js")
+
+	errBoom := errors.New("boom")
+	_, err = build(func(ctx context.Context, v Version, dir string) error {
+		return errBoom
+	})
+	c.Assert(err, qt.ErrorMatches, "failed to transform foo@v1.2.0: boom")
+	c.Assert(errors.Is(err, errBoom), qt.IsTrue)
+}
+
+func TestScopedPackageTempFiles(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("@scope/foo", "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+
+	workDir := c.TempDir()
+	var files []string
+	client := NewClient(ClientOptions{Registry: registry.URL, WorkDir: workDir, Transform: func(ctx context.Context, v Version, dir string) error {
+		rel, err := filepath.Rel(workDir, dir)
+		if err != nil {
+			return err
+		}
+		c.Assert(strings.Count(filepath.ToSlash(rel), "/"), qt.Equals, 1, qt.Commentf(rel))
+		entries, err := os.ReadDir(filepath.Dir(dir))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			files = append(files, e.Name())
+		}
+		return nil
+	}})
+	v, err := client.FetchPackageVersion(context.Background(), "@scope/foo", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	f, err := client.CreateZipFromVersion(context.Background(), v)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	c.Assert(files, qt.DeepEquals, []string{"@scope%2Ffoo", "@scope%2Ffoo-v1.0.0-" + v.Dist.ShaSum})
+	entries, err := os.ReadDir(workDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+
+	c.Assert(fileName("@a/b_c"), qt.Not(qt.Equals), fileName("@a_b/c"))
+}
+
+func TestParseShrinkwrap(t *testing.T) {
+	c := qt.New(t)
+
+	v := Version{
+		Dependencies:         Dependencies{{Name: "a", VersionRange: "^1.0.0"}, {Name: "@s/b", VersionRange: "^2.0.0"}, {Name: "linked", VersionRange: "*"}},
+		OptionalDependencies: Dependencies{{Name: "git", VersionRange: "github:user/git"}},
+	}
+
+	// lockfileVersion 2 and 3.
+	sw, err := parseShrinkwrap([]byte(`{"lockfileVersion": 2, "packages": {
+		"": {"name": "foo"},
+		"node_modules/a": {"version": "1.0.1"},
+		"node_modules/@s/b": {"version": "2.3.0+build.1"},
+		"node_modules/linked": {"link": true, "resolved": "../linked"},
+		"node_modules/git": {"version": "git+ssh://git@github.com/user/git.git#abc"},
+		"node_modules/unused": {"version": "1.0.0"}
+	}, "dependencies": {"a": {"version": "1.0.0"}}}`), v)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sw, qt.DeepEquals, Shrinkwrap{"a": "v1.0.1", "@s/b": "v2.3.0"})
+
+	// lockfileVersion 1.
+	sw, err = parseShrinkwrap([]byte(`{"lockfileVersion": 1, "dependencies": {
+		"a": {"version": "1.0.2", "dependencies": {"@s/b": {"version": "2.0.0"}}},
+		"git": {"version": "github:user/git#abc"}
+	}}`), v)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sw, qt.DeepEquals, Shrinkwrap{"a": "v1.0.2"})
+
+	_, err = parseShrinkwrap([]byte(`{`), v)
+	c.Assert(err, qt.IsNotNil)
+
+	// npm-shrinkwrap.json takes precedence over package-lock.json.
+	b, err := readShrinkwrap(bytes.NewReader(npmtest.Tarball(map[string]string{
+		"package.json":        `{}`,
+		"package-lock.json":   `{"lockfileVersion": 1}`,
+		"npm-shrinkwrap.json": `{"lockfileVersion": 3}`,
+	})))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, `{"lockfileVersion": 3}`)
+	b, err = readShrinkwrap(bytes.NewReader(npmtest.Tarball(map[string]string{"package.json": `{}`})))
+	c.Assert(err, qt.IsNil)
+	c.Assert(b, qt.IsNil)
+}
+
+func TestFileFilters(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{
+		"package.json":            `{}`,
+		"index.js":                "x",
+		"test/a.js":               "a",
+		"test/fixtures/big.json":  "{}",
+		"dist/foo.js":             "x",
+		"dist/foo.js.map":         "{}",
+		"lib/test/helper.js":      "h",
+		"lib/util.js.map":         "{}",
+		"docs/guide/index.md":     "#",
+		"docs/guide/img/logo.png": "png",
+	}, nil)
+	m := module.Version{Path: "gohugo.io/npmjs/foo", Version: "v1.0.0"}
+
+	files := func(opts ClientOptions) []string {
+		opts.Registry = registry.URL
+		client := NewClient(opts)
+		v, err := client.FetchPackageVersion(context.Background(), "foo", "v1.0.0")
+		c.Assert(err, qt.IsNil)
+		f, err := client.CreateZipFromVersion(context.Background(), v)
+		c.Assert(err, qt.IsNil)
+		defer f.Close()
+		_, err = f.Seek(0, io.SeekStart)
+		c.Assert(err, qt.IsNil)
+		b, err := io.ReadAll(f)
+		c.Assert(err, qt.IsNil)
+		zipFilename := filepath.Join(c.TempDir(), "foo.zip")
+		c.Assert(os.WriteFile(zipFilename, b, 0o644), qt.IsNil)
+		cf, err := zip.CheckZip(m, zipFilename)
+		c.Assert(err, qt.IsNil)
+		var names []string
+		for _, name := range cf.Valid {
+			names = append(names, strings.TrimPrefix(name, m.String()+"/"))
+		}
+		return names
+	}
+
+	for _, maxInMemorySize := range []int64{0, 1 << 20} {
+		c.Assert(files(ClientOptions{MaxInMemorySize: maxInMemorySize, ExcludeFiles: []string{"/test/", "*.map", "docs"}}), qt.DeepEquals, []string{
+			"package/dist/foo.js",
+			"package/index.js",
+			"package/lib/test/helper.js",
+			"package/package.json",
+		})
+
+		c.Assert(files(ClientOptions{MaxInMemorySize: maxInMemorySize, IncludeFiles: []string{"dist", "*.md"}, ExcludeFiles: []string{"*.map"}}), qt.DeepEquals, []string{
+			"package/dist/foo.js",
+			"package/docs/guide/index.md",
+			"package/package.json",
+		})
+
+		// The package.json can't be excluded.
+		c.Assert(files(ClientOptions{MaxInMemorySize: maxInMemorySize, ExcludeFiles: []string{"*"}}), qt.DeepEquals, []string{"package/package.json"})
+	}
+
+	c.Assert(CheckFilePatterns([]string{"test/", "*.map"}), qt.IsNil)
+	c.Assert(CheckFilePatterns([]string{"[foo"}), qt.ErrorMatches, `invalid file pattern "\[foo": .*`)
+}
+
+func TestMetadataTTLJitter(t *testing.T) {
+	c := qt.New(t)
+
+	expiries := func(jitter float64) (earliest, latest time.Time) {
+		client := NewClient(ClientOptions{MetadataTTL: time.Hour, MetadataTTLJitter: jitter})
+		for i := 0; i < 100; i++ {
+			client.cachePackage(fmt.Sprintf("pkg%d", i), NpmPackage{})
+		}
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		for _, cp := range client.packages {
+			if earliest.IsZero() || cp.expires.Before(earliest) {
+				earliest = cp.expires
+			}
+			if cp.expires.After(latest) {
+				latest = cp.expires
+			}
+		}
+		return earliest, latest
+	}
+
+	now := time.Now()
+	earliest, latest := expiries(0)
+	c.Assert(latest.Sub(earliest) < time.Second, qt.IsTrue)
+
+	earliest, latest = expiries(0.2)
+	c.Assert(latest.Sub(earliest) > 10*time.Minute, qt.IsTrue, qt.Commentf("expiries spread over %s", latest.Sub(earliest)))
+	c.Assert(earliest.After(now.Add(48*time.Minute)), qt.IsTrue)
+	c.Assert(latest.Before(time.Now().Add(72*time.Minute)), qt.IsTrue)
+}
+
+func TestFetchPackageCoalescing(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+	registry.OnRequest = func(req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client := NewClient(ClientOptions{Registry: registry.URL, MetadataTTL: time.Hour})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := client.FetchPackage(context.Background(), "foo")
+			c.Check(err, qt.IsNil)
+			c.Check(p.Versions, qt.HasLen, 1)
+		}()
+	}
+	wg.Wait()
+	c.Assert(registry.Hits("/foo"), qt.Equals, 1)
+
+	// A cancelled caller doesn't fail the others.
+	client = NewClient(ClientOptions{Registry: registry.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := client.FetchPackage(ctx, "foo")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err := client.FetchPackage(context.Background(), "foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(errors.Is(<-done, context.Canceled), qt.IsTrue)
+}
+
+func TestMetadataStaleWhileRevalidate(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`}, nil)
+
+	var (
+		mu      sync.Mutex
+		fetches int
+	)
+	release := make(chan struct{})
+	registry.OnRequest = func(req *http.Request) {
+		if req.URL.Path != "/foo" {
+			return
+		}
+		mu.Lock()
+		fetches++
+		refresh := fetches > 1
+		mu.Unlock()
+		if refresh {
+			<-release
+		}
+	}
+	fetchCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+	client := NewClient(ClientOptions{Registry: registry.URL, MetadataTTL: 10 * time.Millisecond, MetadataStaleWhileRevalidate: time.Hour})
+	fetchLatest := func() string {
+		p, err := client.FetchPackage(context.Background(), "foo")
+		c.Assert(err, qt.IsNil)
+		return p.DistTags.Latest
+	}
+
+	c.Assert(fetchLatest(), qt.Equals, "v1.0.0")
+	registry.AddVersion("foo", "1.1.0", map[string]string{"package.json": `{}`}, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	// The stale document is served while a single refresh is blocked.
+	for i := 0; i < 3; i++ {
+		c.Assert(fetchLatest(), qt.Equals, "v1.0.0")
+	}
+	for fetchCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(fetchLatest(), qt.Equals, "v1.0.0")
+	c.Assert(fetchCount(), qt.Equals, 2)
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for fetchLatest() != "v1.1.0" {
+		if time.Now().After(deadline) {
+			c.Fatal("package document not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Past the stale window the document is fetched again before it's served.
+	client = NewClient(ClientOptions{Registry: registry.URL, MetadataTTL: time.Millisecond})
+	c.Assert(fetchLatest(), qt.Equals, "v1.1.0")
+	registry.AddVersion("foo", "1.2.0", map[string]string{"package.json": `{}`}, nil)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(fetchLatest(), qt.Equals, "v1.2.0")
+}
+
+func TestByVersionIndex(t *testing.T) {
+	c := qt.New(t)
+
+	var p NpmPackage
+	c.Assert(json.Unmarshal(largePackageDocument(500), &p), qt.IsNil)
+	c.Assert(p.Versions, qt.HasLen, 500)
+	c.Assert(p.index, qt.HasLen, len(p.Versions))
+
+	for i, v := range p.Versions {
+		c.Assert(p.index[v.Version], qt.Equals, i)
+		got, found := p.ByVersion(v.Version)
+		c.Assert(found, qt.IsTrue)
+		c.Assert(got.Version, qt.Equals, v.Version)
+		c.Assert(got.Dist.ShaSum, qt.Equals, v.Dist.ShaSum)
+	}
+	_, found := p.ByVersion("v9.9.9")
+	c.Assert(found, qt.IsFalse)
+
+	// Lookups still work when Versions is changed after the decode.
+	p.Versions = append(Versions{{Name: "foo", Version: "v0.0.1"}}, p.Versions...)
+	got, found := p.ByVersion("v1.0.0")
+	c.Assert(found, qt.IsTrue)
+	c.Assert(got.Version, qt.Equals, "v1.0.0")
+	_, found = p.ByVersion("v0.0.1")
+	c.Assert(found, qt.IsTrue)
+
+	npmv, err := p.lookupVersion("foo", "v1.0.3")
+	c.Assert(err, qt.IsNil)
+	c.Assert(npmv.Version, qt.Equals, "v1.0.3")
+}
+
+// BenchmarkByVersion compares the version index with scanning the versions.
+func BenchmarkByVersion(b *testing.B) {
+	var p NpmPackage
+	if err := json.Unmarshal(largePackageDocument(5000), &p); err != nil {
+		b.Fatal(err)
+	}
+	versions := make([]string, len(p.Versions))
+	for i, v := range p.Versions {
+		versions[i] = v.Version
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, found := p.Versions.ByVersion(versions[i%len(versions)]); !found {
+				b.Fatal("not found")
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, found := p.ByVersion(versions[i%len(versions)]); !found {
+				b.Fatal("not found")
+			}
+		}
+	})
+}
+
+// largePackageDocument returns a package document for foo with n versions.
+func largePackageDocument(n int) []byte {
+	versions := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		v := fmt.Sprintf("%d.%d.%d", 1+i/1000, (i/10)%100, i%10)
+		versions[v] = map[string]interface{}{
+			"name":    "foo",
+			"version": v,
+			"dist":    map[string]string{"shasum": fmt.Sprintf("%040d", i), "tarball": "https://registry.example.org/foo/-/foo-" + v + ".tgz"},
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"name":      "foo",
+		"dist-tags": map[string]string{"latest": "1.0.0"},
+		"versions":  versions,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
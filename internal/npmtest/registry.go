@@ -0,0 +1,242 @@
+// Package npmtest provides a fake npm registry for use in tests.
+package npmtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry is a fake npm registry backed by an httptest.Server.
+type Registry struct {
+	*httptest.Server
+
+	// OnRequest, if set, is called before each request is served,
+	// without holding any locks.
+	OnRequest func(req *http.Request)
+
+	// Gzip, if set, gzips the package documents sent
+	// to clients accepting a gzip Content-Encoding.
+	Gzip bool
+
+	mu       sync.Mutex
+	packages map[string]map[string]interface{}
+	files    map[string][]byte
+	hits     map[string]int
+	sent     int64
+}
+
+// NewRegistry creates and starts a new Registry.
+// The caller must call Close when done.
+func NewRegistry() *Registry {
+	r := &Registry{
+		packages: make(map[string]map[string]interface{}),
+		files:    make(map[string][]byte),
+		hits:     make(map[string]int),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// AddVersion adds version of pkg to the registry with a tarball
+// containing files, stored below package/ as npm does.
+// Any extra fields are merged into the version document.
+func (r *Registry) AddVersion(pkg, version string, files map[string]string, extra map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tarball := Tarball(files)
+	tarballPath := TarballPath(pkg, version)
+	r.files[tarballPath] = tarball
+
+	doc, found := r.packages[pkg]
+	if !found {
+		doc = map[string]interface{}{
+			"name":      pkg,
+			"dist-tags": map[string]string{},
+			"versions":  map[string]interface{}{},
+			"time": map[string]interface{}{
+				"created": publishTime(0),
+			},
+		}
+		r.packages[pkg] = doc
+	}
+
+	shasum := sha1.Sum(tarball)
+	integrity := sha512.Sum512(tarball)
+
+	v := map[string]interface{}{
+		"name":    pkg,
+		"version": version,
+		"dist": map[string]interface{}{
+			"shasum":    hex.EncodeToString(shasum[:]),
+			"integrity": "sha512-" + base64.StdEncoding.EncodeToString(integrity[:]),
+			"tarball":   r.URL + tarballPath,
+		},
+	}
+	for k, vv := range extra {
+		v[k] = vv
+	}
+
+	versions := doc["versions"].(map[string]interface{})
+	versions[version] = v
+	doc["dist-tags"].(map[string]string)["latest"] = version
+	times := doc["time"].(map[string]interface{})
+	times[version] = publishTime(len(versions))
+	times["modified"] = publishTime(len(versions))
+}
+
+// Unpublish removes version of pkg from the registry the way npm does,
+// keeping its entry in the package's time field.
+func (r *Registry) Unpublish(pkg, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.packages[pkg]["versions"].(map[string]interface{}), version)
+}
+
+// publishTime returns a deterministic publish time for the n-th version.
+func publishTime(n int) time.Time {
+	return time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(n) * time.Hour)
+}
+
+// UpdateVersion calls fn with the version document of pkg@version for modification.
+func (r *Registry) UpdateVersion(pkg, version string, fn func(v map[string]interface{})) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r.packages[pkg]["versions"].(map[string]interface{})[version].(map[string]interface{}))
+}
+
+// SetDistTag points the dist-tag tag of pkg to version.
+func (r *Registry) SetDistTag(pkg, tag, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packages[pkg]["dist-tags"].(map[string]string)[tag] = version
+}
+
+// Hits returns the number of requests served for the given path.
+func (r *Registry) Hits(p string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hits[p]
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.OnRequest != nil {
+		r.OnRequest(req)
+	}
+
+	b, contentType, found := r.lookup(req.URL.Path)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if r.Gzip && contentType == "application/json" && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		gzw.Write(b)
+		gzw.Close()
+		b = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	n, _ := w.Write(b)
+
+	r.mu.Lock()
+	r.sent += int64(n)
+	r.mu.Unlock()
+}
+
+// Sent returns the number of response body bytes sent, as transferred.
+func (r *Registry) Sent() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent
+}
+
+// lookup returns the response body and content type for the path p.
+func (r *Registry) lookup(p string) ([]byte, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hits[p]++
+
+	if b, found := r.files[p]; found {
+		return b, "application/octet-stream", true
+	}
+
+	name := strings.TrimPrefix(p, "/")
+	if doc, found := r.packages[name]; found {
+		b, _ := json.Marshal(doc)
+		return b, "application/json", true
+	}
+
+	// The per-version endpoint, e.g. /foo/1.0.0.
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		if doc, found := r.packages[name[:i]]; found {
+			if v, found := doc["versions"].(map[string]interface{})[name[i+1:]]; found {
+				b, _ := json.Marshal(v)
+				return b, "application/json", true
+			}
+		}
+	}
+
+	return nil, "", false
+}
+
+// TarballPath returns the path the tarball for pkg@version is served from.
+func TarballPath(pkg, version string) string {
+	return "/" + pkg + "/-/" + path.Base(pkg) + "-" + version + ".tgz"
+}
+
+// Tarball creates a gzipped tarball with files stored below package/.
+func Tarball(files map[string]string) []byte {
+	return TarballRoot("package", files)
+}
+
+// TarballRoot is like Tarball, but stores files below root/, as
+// tarballs not published to a registry, e.g. from GitHub, do.
+func TarballRoot(root string, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{
+			Name:     path.Join(root, name),
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gzw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,375 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// RangeKind classifies the version part of a npm dependency.
+type RangeKind int
+
+const (
+	// RangeSemver is a semver range, e.g. ^1.2.3 or >=1 <2.
+	RangeSemver RangeKind = iota
+
+	// RangeTag is a dist-tag, e.g. latest.
+	RangeTag
+
+	// RangeLocal is a reference to a local path, e.g. file:../foo or workspace:*.
+	RangeLocal
+
+	// RangeURL is a git, GitHub shorthand or tarball URL reference.
+	RangeURL
+
+	// RangeInvalid is anything else.
+	RangeInvalid
+)
+
+var distTagRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]*$`)
+
+// IsDistTag reports whether s looks like a npm dist-tag, e.g. latest or next.
+func IsDistTag(s string) bool {
+	return distTagRe.MatchString(s)
+}
+
+// ClassifyRange returns the kind of the npm version range r.
+func ClassifyRange(r string) RangeKind {
+	r = strings.TrimSpace(r)
+
+	for _, prefix := range []string{"file:", "link:", "workspace:"} {
+		if strings.HasPrefix(r, prefix) {
+			return RangeLocal
+		}
+	}
+
+	for _, prefix := range []string{"git:", "git+", "github:", "gitlab:", "bitbucket:", "gist:", "http:", "https:", "npm:"} {
+		if strings.HasPrefix(r, prefix) {
+			return RangeURL
+		}
+	}
+
+	if _, err := parseRange(r); err == nil {
+		return RangeSemver
+	}
+
+	if strings.Contains(r, "/") {
+		// GitHub shorthand, e.g. user/repo#branch.
+		return RangeURL
+	}
+
+	if IsDistTag(r) {
+		return RangeTag
+	}
+
+	return RangeInvalid
+}
+
+// ResolveRange returns the highest version of p matching the npm version range r,
+// skipping the versions without a tarball.
+// Dist-tags, e.g. latest, are resolved via p.DistTags.
+func (p NpmPackage) ResolveRange(r string) (Version, error) {
+	switch ClassifyRange(r) {
+	case RangeTag:
+		v, found := p.DistTags.Tags[strings.TrimSpace(r)]
+		if !found {
+			return Version{}, fmt.Errorf("dist-tag %q not found for package %q", r, p.Name)
+		}
+		npmv, found := p.ByVersion(v)
+		if !found {
+			return Version{}, fmt.Errorf("version %q for dist-tag %q not found for package %q", v, r, p.Name)
+		}
+		if !npmv.HasTarball() {
+			return Version{}, fmt.Errorf("version %q for dist-tag %q of package %q has no tarball", v, r, p.Name)
+		}
+		return npmv, nil
+	case RangeSemver:
+	default:
+		return Version{}, fmt.Errorf("unsupported version range %q for package %q", r, p.Name)
+	}
+
+	sets, err := parseRange(r)
+	if err != nil {
+		return Version{}, err
+	}
+
+	for i := len(p.Versions) - 1; i >= 0; i-- {
+		v := p.Versions[i]
+		if !v.HasTarball() {
+			continue
+		}
+		for _, set := range sets {
+			if set.matches(v.Version) {
+				return v, nil
+			}
+		}
+	}
+
+	return Version{}, fmt.Errorf("no version of package %q matches %q", p.Name, r)
+}
+
+type comparator struct {
+	op      string // One of =, <, <=, >, >=.
+	version string // Go semver, e.g. v1.2.3.
+}
+
+func (c comparator) matches(v string) bool {
+	cmp := semver.Compare(v, c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// comparatorSet is a set of comparators that must all match.
+type comparatorSet []comparator
+
+func (set comparatorSet) matches(v string) bool {
+	if !semver.IsValid(v) {
+		return false
+	}
+	for _, c := range set {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	if semver.Prerelease(v) == "" {
+		return true
+	}
+	// As in npm, pre-releases only match if a comparator
+	// in the set has a pre-release on the same version tuple.
+	tuple := strings.TrimSuffix(semver.Canonical(v), semver.Prerelease(v))
+	for _, c := range set {
+		if pre := semver.Prerelease(c.version); pre != "" && strings.TrimSuffix(semver.Canonical(c.version), pre) == tuple {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses a npm semver range, e.g. "^1.2.3 || >=2.0.0 <3".
+func parseRange(r string) ([]comparatorSet, error) {
+	var sets []comparatorSet
+	for _, part := range strings.Split(r, "||") {
+		set, err := parseComparatorSet(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version range %q: %w", r, err)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func parseComparatorSet(s string) (comparatorSet, error) {
+	if lo, hi, found := splitHyphen(s); found {
+		vlo, err := parsePartial(lo)
+		if err != nil {
+			return nil, err
+		}
+		vhi, err := parsePartial(hi)
+		if err != nil {
+			return nil, err
+		}
+		return comparatorSet{{">=", vlo.floor()}}.add(vhi.upper(true)...), nil
+	}
+
+	fields := strings.Fields(s)
+
+	// Join operators separated from their version, e.g. ">= 1.2.3".
+	var tokens []string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if strings.Trim(f, "<>=~^") == "" && i+1 < len(fields) {
+			f += fields[i+1]
+			i++
+		}
+		tokens = append(tokens, f)
+	}
+
+	var set comparatorSet
+	for _, token := range tokens {
+		cs, err := parseComparator(token)
+		if err != nil {
+			return nil, err
+		}
+		set = set.add(cs...)
+	}
+	return set, nil
+}
+
+func (set comparatorSet) add(cs ...comparator) comparatorSet {
+	return append(set, cs...)
+}
+
+func splitHyphen(s string) (string, string, bool) {
+	i := strings.Index(s, " - ")
+	if i == -1 {
+		return "", "", false
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+3:]), true
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", "~>", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+	if op == "~>" {
+		op = "~"
+	}
+
+	v, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.isAny() {
+		if op == "<" || op == ">" {
+			// Nothing matches, e.g. <*.
+			return []comparator{{"<", "v0.0.0-0"}}, nil
+		}
+		return nil, nil
+	}
+
+	switch op {
+	case "", "=":
+		if v.isFull() {
+			return []comparator{{"=", v.floor()}}, nil
+		}
+		return append([]comparator{{">=", v.floor()}}, v.upper(false)...), nil
+	case "^":
+		// Caret allows changes that don't modify the left-most non-zero part,
+		// e.g. ^0.2.3 is <0.3.0 and ^0.0.3 is <0.0.4.
+		switch {
+		case v.major > 0 || v.minor < 0:
+			return []comparator{{">=", v.floor()}, {"<", fmt.Sprintf("v%d.0.0-0", v.major+1)}}, nil
+		case v.minor > 0 || v.patch < 0:
+			return []comparator{{">=", v.floor()}, {"<", fmt.Sprintf("v0.%d.0-0", v.minor+1)}}, nil
+		default:
+			return []comparator{{">=", v.floor()}, {"<", fmt.Sprintf("v0.0.%d-0", v.patch+1)}}, nil
+		}
+	case "~":
+		if v.minor < 0 {
+			return []comparator{{">=", v.floor()}, {"<", fmt.Sprintf("v%d.0.0-0", v.major+1)}}, nil
+		}
+		return []comparator{{">=", v.floor()}, {"<", fmt.Sprintf("v%d.%d.0-0", v.major, v.minor+1)}}, nil
+	case ">":
+		if v.isFull() {
+			return []comparator{{">", v.floor()}}, nil
+		}
+		return []comparator{{">=", v.next()}}, nil
+	case ">=":
+		return []comparator{{">=", v.floor()}}, nil
+	case "<":
+		return []comparator{{"<", v.floor()}}, nil
+	case "<=":
+		return v.upper(true), nil
+	}
+
+	return nil, fmt.Errorf("invalid comparator %q", s)
+}
+
+// partialVersion is a possibly partial version, e.g. 1, 1.2.x or 1.2.3-beta.1.
+// Missing or wildcard parts are -1.
+type partialVersion struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+func parsePartial(s string) (partialVersion, error) {
+	v := partialVersion{major: -1, minor: -1, patch: -1}
+
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if i := strings.Index(s, "+"); i != -1 {
+		// Build metadata does not take part in comparisons.
+		s = s[:i]
+	}
+	if s == "" {
+		return v, nil
+	}
+
+	if i := strings.Index(s, "-"); i != -1 {
+		v.prerelease = s[i:]
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+
+	if v.prerelease != "" && !v.isFull() {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+
+	return v, nil
+}
+
+func (v partialVersion) isAny() bool {
+	return v.major < 0
+}
+
+func (v partialVersion) isFull() bool {
+	return v.patch >= 0
+}
+
+func (v partialVersion) floor() string {
+	minor, patch := v.minor, v.patch
+	if minor < 0 {
+		minor = 0
+	}
+	if patch < 0 {
+		patch = 0
+	}
+	return fmt.Sprintf("v%d.%d.%d%s", v.major, minor, patch, v.prerelease)
+}
+
+// next returns the first version above all versions matching v.
+func (v partialVersion) next() string {
+	if v.minor < 0 {
+		return fmt.Sprintf("v%d.0.0-0", v.major+1)
+	}
+	return fmt.Sprintf("v%d.%d.0-0", v.major, v.minor+1)
+}
+
+// upper returns the upper bound of the versions matching v.
+func (v partialVersion) upper(inclusive bool) []comparator {
+	if v.isFull() {
+		if inclusive {
+			return []comparator{{"<=", v.floor()}}
+		}
+		return []comparator{{"<", v.floor()}}
+	}
+	if v.isAny() {
+		return nil
+	}
+	return []comparator{{"<", v.next()}}
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClassifyRange(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		r    string
+		kind RangeKind
+	}{
+		{"^1.2.3", RangeSemver},
+		{">=1.0.0 <2", RangeSemver},
+		{"1.x || 2.x", RangeSemver},
+		{"*", RangeSemver},
+		{"", RangeSemver},
+		{"latest", RangeTag},
+		{"next", RangeTag},
+		{"file:../foo", RangeLocal},
+		{"workspace:*", RangeLocal},
+		{"link:../foo", RangeLocal},
+		{"github:user/repo", RangeURL},
+		{"git+https://github.com/user/repo.git", RangeURL},
+		{"https://example.org/foo.tgz", RangeURL},
+		{"user/repo#main", RangeURL},
+		{"^^1", RangeInvalid},
+	} {
+		c.Assert(ClassifyRange(test.r), qt.Equals, test.kind, qt.Commentf(test.r))
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	c := qt.New(t)
+
+	p := testPackage("v1.0.0", "v1.2.3", "v1.2.9", "v1.3.0", "v2.0.0-beta.1", "v2.0.0", "v2.1.0", "v3.0.0")
+	p.DistTags = DistTags{Latest: "v2.1.0", Tags: map[string]string{"latest": "v2.1.0", "beta": "v2.0.0-beta.1"}}
+
+	for _, test := range []struct {
+		r    string
+		want string
+	}{
+		{"^1.2.3", "v1.3.0"},
+		{"~1.2.3", "v1.2.9"},
+		{"1.2.x", "v1.2.9"},
+		{"1", "v1.3.0"},
+		{"1.2.3", "v1.2.3"},
+		{"=1.2.3", "v1.2.3"},
+		{">=1.0.0 <2", "v1.3.0"},
+		{">= 1.0.0 < 2", "v1.3.0"},
+		{"<2.0.0", "v1.3.0"},
+		{">2.0.0", "v3.0.0"},
+		{">1", "v3.0.0"},
+		{"<=1.2", "v1.2.9"},
+		{"1.0.0 - 1.2", "v1.2.9"},
+		{"^1.2.3 || ^2", "v2.1.0"},
+		{"2.0.0-beta.1", "v2.0.0-beta.1"},
+		{"*", "v3.0.0"},
+		{"", "v3.0.0"},
+		{"latest", "v2.1.0"},
+		{"beta", "v2.0.0-beta.1"},
+	} {
+		v, err := p.ResolveRange(test.r)
+		c.Assert(err, qt.IsNil, qt.Commentf(test.r))
+		c.Assert(v.Version, qt.Equals, test.want, qt.Commentf(test.r))
+	}
+
+	_, err := p.ResolveRange("^4.0.0")
+	c.Assert(err, qt.ErrorMatches, `no version of package "foo" matches "\^4.0.0"`)
+	_, err = p.ResolveRange("canary")
+	c.Assert(err, qt.ErrorMatches, `dist-tag "canary" not found.*`)
+	_, err = p.ResolveRange("file:../foo")
+	c.Assert(err, qt.ErrorMatches, `unsupported version range.*`)
+}
+
+func TestResolveRangeWithoutTarball(t *testing.T) {
+	c := qt.New(t)
+
+	p := testPackage("v1.0.0", "v1.1.0", "v1.2.0")
+	p.Versions[2].Dist = Dist{}
+	p.DistTags = DistTags{Latest: "v1.2.0", Tags: map[string]string{"latest": "v1.2.0"}}
+
+	v, err := p.ResolveRange("^1.0.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(v.Version, qt.Equals, "v1.1.0")
+	_, err = p.ResolveRange("1.2.0")
+	c.Assert(err, qt.ErrorMatches, `no version of package "foo" matches "1.2.0"`)
+	_, err = p.ResolveRange("latest")
+	c.Assert(err, qt.ErrorMatches, `version "v1.2.0" for dist-tag "latest" of package "foo" has no tarball`)
+}
+
+func TestResolveRangeZeroMajor(t *testing.T) {
+	c := qt.New(t)
+
+	p := testPackage("v0.0.3", "v0.0.4", "v0.1.0", "v0.2.3", "v0.2.5", "v0.3.0", "v1.2.3", "v1.4.0", "v2.0.0")
+
+	for _, test := range []struct {
+		r    string
+		want string
+	}{
+		{"^0.2.3", "v0.2.5"},
+		{"~0.2.3", "v0.2.5"},
+		{"^0.0.3", "v0.0.3"},
+		{"~0.0.3", "v0.0.4"},
+		{"^0.0", "v0.0.4"},
+		{"^0.0.x", "v0.0.4"},
+		{"^0.2", "v0.2.5"},
+		{"^0", "v0.3.0"},
+		{"^0.x", "v0.3.0"},
+		{"~0", "v0.3.0"},
+		{"^1.2.3", "v1.4.0"},
+		{"~1.2.3", "v1.2.3"},
+	} {
+		v, err := p.ResolveRange(test.r)
+		c.Assert(err, qt.IsNil, qt.Commentf(test.r))
+		c.Assert(v.Version, qt.Equals, test.want, qt.Commentf(test.r))
+	}
+
+	_, err := p.ResolveRange("^0.1.1")
+	c.Assert(err, qt.ErrorMatches, `no version of package "foo" matches "\^0.1.1"`)
+}
+
+func testPackage(versions ...string) NpmPackage {
+	p := NpmPackage{Name: "foo"}
+	for _, v := range versions {
+		p.Versions = append(p.Versions, Version{Name: "foo", Version: v, Dist: Dist{Tarball: "https://registry.npmjs.org/foo/-/foo-" + v[1:] + ".tgz"}})
+	}
+	return p
+}
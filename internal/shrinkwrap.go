@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/semver"
+)
+
+// shrinkwrapFiles are the lockfiles read from package tarballs, in order of
+// precedence. npm publishes npm-shrinkwrap.json, but never package-lock.json,
+// which some other tools do.
+var shrinkwrapFiles = []string{"package/npm-shrinkwrap.json", "package/package-lock.json"}
+
+// maxShrinkwrapSize is the maximum size in bytes of a lockfile read from a tarball.
+const maxShrinkwrapSize = 16 << 20
+
+// Shrinkwrap maps the names of the dependencies of a package version
+// to the versions, e.g. v1.2.3, pinned by the lockfile in its tarball.
+type Shrinkwrap map[string]string
+
+// FetchShrinkwrap downloads the tarball of v and returns the versions of
+// its dependencies pinned by its npm-shrinkwrap.json or package-lock.json,
+// nil if it has none. The tarball isn't downloaded for versions flagged
+// as having no shrinkwrap in the registry's metadata, as npm does.
+func (c *Client) FetchShrinkwrap(ctx context.Context, v Version) (Shrinkwrap, error) {
+	if v.HasShrinkwrap != nil && !*v.HasShrinkwrap {
+		return nil, nil
+	}
+
+	key := v.Name + "@" + v.Version
+	c.mu.Lock()
+	sw, found := c.shrinkwraps[key]
+	c.mu.Unlock()
+	if found {
+		return sw, nil
+	}
+
+	tempDir, err := os.MkdirTemp(c.opts.WorkDir, "npmgop")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tarFilename := filepath.Join(tempDir, "package.tgz")
+	if err := c.downloadTarball(ctx, v.Dist, tarFilename); err != nil {
+		return nil, fmt.Errorf("failed to download tarball: %w", err)
+	}
+	f, err := os.Open(tarFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := readShrinkwrap(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read shrinkwrap: %w", key, err)
+	}
+	if b != nil {
+		sw, err = parseShrinkwrap(b, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse shrinkwrap: %w", key, err)
+		}
+	}
+
+	c.mu.Lock()
+	c.shrinkwraps[key] = sw
+	c.mu.Unlock()
+
+	return sw, nil
+}
+
+// readShrinkwrap returns the content of the lockfile with the highest
+// precedence in the tarball in r, nil if there is none.
+func readShrinkwrap(r io.Reader) ([]byte, error) {
+	r, err := decompressTarball(r)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := packageEntryName(header.Name)
+		for _, filename := range shrinkwrapFiles {
+			if name != filename {
+				continue
+			}
+			b, err := io.ReadAll(io.LimitReader(tr, maxShrinkwrapSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(b) > maxShrinkwrapSize {
+				return nil, fmt.Errorf("%s exceeds %d bytes", filename, maxShrinkwrapSize)
+			}
+			found[filename] = b
+		}
+	}
+
+	for _, filename := range shrinkwrapFiles {
+		if b, ok := found[filename]; ok {
+			return b, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseShrinkwrap parses the versions pinned for the dependencies of v
+// from the lockfile b, in the lockfileVersion 2 and 3 packages format or
+// the older dependencies one. Dependencies not pinned to a registry
+// version, e.g. links and git URLs, are left out.
+func parseShrinkwrap(b []byte, v Version) (Shrinkwrap, error) {
+	type entry struct {
+		Version string `json:"version"`
+		Link    bool   `json:"link"`
+	}
+	var lock struct {
+		Packages     map[string]entry `json:"packages"`
+		Dependencies map[string]entry `json:"dependencies"`
+	}
+	if err := json.Unmarshal(b, &lock); err != nil {
+		return nil, err
+	}
+
+	sw := make(Shrinkwrap)
+	for _, deps := range []Dependencies{v.Dependencies, v.OptionalDependencies, v.PeerDependencies} {
+		for _, dep := range deps {
+			e, found := lock.Packages["node_modules/"+dep.Name]
+			if !found && lock.Packages == nil {
+				e, found = lock.Dependencies[dep.Name]
+			}
+			if !found || e.Link {
+				continue
+			}
+			if pinned := normalizeSemver(e.Version); semver.IsValid(pinned) {
+				sw[dep.Name] = pinned
+			}
+		}
+	}
+	return sw, nil
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// githubSpecRe matches the GitHub git URL forms npm accepts, e.g.
+// github:user/repo#v1.2.3 and git+https://github.com/user/repo.git#main.
+var githubSpecRe = regexp.MustCompile(`^(?:github:|git\+https://github\.com/|https://github\.com/)([\w.-]+)/([\w.-]+?)(?:\.git)?(?:#(.+))?$`)
+
+// IsURLPackage reports whether spec is a package given as a tarball
+// or git URL rather than by name, e.g. https://example.org/foo-1.0.0.tgz
+// or github:user/repo#v1.0.0.
+func IsURLPackage(spec string) bool {
+	return strings.HasPrefix(spec, "github:") || strings.Contains(spec, "://")
+}
+
+// urlPackageTarball returns the tarball URL for the URL package spec.
+func urlPackageTarball(spec string) (string, error) {
+	if m := githubSpecRe.FindStringSubmatch(spec); m != nil {
+		ref := m[3]
+		if ref == "" {
+			ref = "HEAD"
+		}
+		return fmt.Sprintf("https://codeload.github.com/%s/%s/tar.gz/%s", m[1], m[2], url.PathEscape(ref)), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("unsupported URL package %q: only tarball URLs and GitHub git URLs are supported", spec)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL package %q: only https URLs are supported", spec)
+	}
+	return u.String(), nil
+}
+
+// CreateZipFromURLPackage fetches the package given as a tarball or GitHub
+// git URL, see IsURLPackage, from one of the hosts in ClientOptions.URLHosts,
+// and repacks it as a module zip, as CreateZipFromVersion does. The name,
+// version and dependencies are read from the package.json in the tarball,
+// which is downloaded once, and the returned version's Dist carries its shasum.
+func (c *Client) CreateZipFromURLPackage(ctx context.Context, spec string) (Version, nameReadSeekCloser, error) {
+	var v Version
+
+	tarball, err := urlPackageTarball(spec)
+	if err != nil {
+		return v, nil, err
+	}
+	u, err := url.Parse(tarball)
+	if err != nil {
+		return v, nil, err
+	}
+	if err := c.checkURLPackageURL(u); err != nil {
+		return v, nil, fmt.Errorf("URL package %q: %w", spec, err)
+	}
+
+	shasum := sha1.New()
+	t, err := c.spill(path.Base(u.Path), c.zipThreshold(), func(w io.Writer) error {
+		return c.fetchURLTarball(ctx, tarball, io.MultiWriter(w, shasum))
+	})
+	if err != nil {
+		return v, nil, fmt.Errorf("URL package %q: %w", spec, err)
+	}
+
+	v, err = readURLPackageVersion(t)
+	if err != nil {
+		t.remove()
+		return v, nil, fmt.Errorf("URL package %q: %w", spec, err)
+	}
+	v.Dist = Dist{Tarball: tarball, ShaSum: hex.EncodeToString(shasum.Sum(nil))}
+
+	f, err := c.repackSpilledTarball(ctx, t, v)
+	if err != nil {
+		return v, nil, err
+	}
+	return v, f, nil
+}
+
+// fetchURLTarball downloads the tarball of a URL package, writing it to w.
+// Unlike registry tarballs, there's no shasum or integrity to check.
+func (c *Client) fetchURLTarball(ctx context.Context, tarball string, w io.Writer) error {
+	resp, err := c.get(ctx, c.urlClient, []string{tarball}, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+
+	// Read one byte past the limit to tell a too large tarball from one of exactly the limit.
+	n, err := io.Copy(w, io.LimitReader(resp.Body, c.opts.MaxTarballSize+1))
+	if err != nil {
+		return err
+	}
+	if n > c.opts.MaxTarballSize {
+		return fmt.Errorf("%s: %w: exceeds %d bytes", tarball, ErrTarballTooLarge, c.opts.MaxTarballSize)
+	}
+	return nil
+}
+
+// readURLPackageVersion returns the version described by the
+// package.json in the tarball t, without its Dist.
+func readURLPackageVersion(t spilledTarball) (Version, error) {
+	var v Version
+
+	var r io.Reader = bytes.NewReader(t.b)
+	if t.filename != "" {
+		f, err := os.Open(t.filename)
+		if err != nil {
+			return v, err
+		}
+		defer f.Close()
+		r = f
+	}
+	b, err := readPackageJSON(r)
+	if err != nil {
+		return v, err
+	}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, fmt.Errorf("invalid package.json: %w", err)
+	}
+	if v.Name == "" {
+		return v, errors.New("package.json has no name")
+	}
+	v.Version = normalizeSemver(v.Version)
+	if !semver.IsValid(v.Version) {
+		return v, fmt.Errorf("invalid version %q in package.json", v.Version)
+	}
+	return v, nil
+}
+
+// checkURLPackageURL checks that URL packages may be fetched from u, also
+// when redirected there: with https from one of ClientOptions.URLHosts.
+// GitHub serves the tarballs from codeload.github.com, which is allowed
+// with github.com.
+func (c *Client) checkURLPackageURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("%s: only https URLs are supported", u.Redacted())
+	}
+	if !c.urlHostAllowed(u.Host) && !(strings.EqualFold(u.Host, "codeload.github.com") && c.urlHostAllowed("github.com")) {
+		return fmt.Errorf("host %s is not allowed", u.Host)
+	}
+	return nil
+}
+
+// checkURLPackageRedirect is checkRedirect for URL packages,
+// see checkURLPackageURL.
+func (c *Client) checkURLPackageRedirect(req *http.Request, via []*http.Request) error {
+	if err := c.checkURLPackageURL(req.URL); err != nil {
+		return err
+	}
+	return c.checkRedirect(req, via)
+}
+
+func (c *Client) urlHostAllowed(host string) bool {
+	for _, h := range c.opts.URLHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPackageJSON returns the package.json in the top-level directory of the tarball in r.
+func readPackageJSON(r io.Reader) ([]byte, error) {
+	r, err := decompressTarball(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("no package.json in tarball")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && packageEntryName(header.Name) == "package/package.json" {
+			return io.ReadAll(io.LimitReader(tr, 1<<20))
+		}
+	}
+}
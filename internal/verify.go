@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Verification is the policy used to verify downloaded tarballs
+// against the checksums in the registry's dist metadata.
+type Verification int
+
+const (
+	// VerifyPreferIntegrity verifies the Subresource Integrity hash when available,
+	// falling back to the SHA-1 shasum.
+	VerifyPreferIntegrity Verification = iota
+
+	// VerifyStrict verifies both the shasum and the integrity hash when available,
+	// falling back to the integrity hash when the shasum is missing.
+	// Any mismatch or a missing checksum fails the download.
+	VerifyStrict
+
+	// VerifySkipOnMissing is like VerifyPreferIntegrity, but skips
+	// verification for versions without any checksum, logging a warning.
+	VerifySkipOnMissing
+)
+
+func (v Verification) String() string {
+	switch v {
+	case VerifyPreferIntegrity:
+		return "prefer-integrity"
+	case VerifyStrict:
+		return "strict"
+	case VerifySkipOnMissing:
+		return "skip-on-missing"
+	}
+	return fmt.Sprintf("Verification(%d)", int(v))
+}
+
+// tarballVerifier computes the checksums of a tarball while it's downloaded.
+type tarballVerifier struct {
+	dist      Dist
+	shasum    hash.Hash
+	integrity *integrityHash
+}
+
+func newTarballVerifier(dist Dist) *tarballVerifier {
+	return &tarballVerifier{
+		dist:      dist,
+		shasum:    sha1.New(),
+		integrity: parseIntegrity(dist.Integrity),
+	}
+}
+
+func (v *tarballVerifier) Write(p []byte) (int, error) {
+	v.shasum.Write(p)
+	if v.integrity != nil {
+		v.integrity.h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks the written bytes according to policy and returns a
+// description of the check used, and whether it's the policy's fallback
+// for a missing checksum.
+func (v *tarballVerifier) verify(policy Verification) (check string, fallback bool, err error) {
+	checkShasum := func() error {
+		if hex.EncodeToString(v.shasum.Sum(nil)) != v.dist.ShaSum {
+			return ErrShasumMismatch
+		}
+		return nil
+	}
+	checkIntegrity := func() error {
+		if !bytes.Equal(v.integrity.h.Sum(nil), v.integrity.sum) {
+			return fmt.Errorf("%w: %s", ErrIntegrityMismatch, v.integrity.alg)
+		}
+		return nil
+	}
+
+	switch policy {
+	case VerifyStrict:
+		// Some registries leave out the shasum, fall back to the integrity hash.
+		if v.dist.ShaSum == "" {
+			if v.integrity == nil {
+				return "", false, missingChecksumError("shasum and integrity")
+			}
+			return "integrity " + v.integrity.alg, true, checkIntegrity()
+		}
+		if err := checkShasum(); err != nil {
+			return "", false, err
+		}
+		if v.integrity == nil {
+			return "shasum", true, nil
+		}
+		if err := checkIntegrity(); err != nil {
+			return "", false, err
+		}
+		return "shasum+integrity " + v.integrity.alg, false, nil
+	default:
+		if v.integrity != nil {
+			return "integrity " + v.integrity.alg, false, checkIntegrity()
+		}
+		if v.dist.ShaSum != "" {
+			return "shasum", true, checkShasum()
+		}
+		if policy == VerifySkipOnMissing {
+			return "none", true, nil
+		}
+		return "", false, missingChecksumError("shasum and integrity")
+	}
+}
+
+// missingChecksumError is ErrMissingChecksum naming the missing checksums.
+type missingChecksumError string
+
+func (e missingChecksumError) Error() string        { return "missing " + string(e) }
+func (e missingChecksumError) Is(target error) bool { return target == ErrMissingChecksum }
+
+type integrityHash struct {
+	alg string
+	h   hash.Hash
+	sum []byte
+}
+
+// parseIntegrity parses the strongest supported hash in the
+// Subresource Integrity string s, e.g. "sha512-<base64>".
+func parseIntegrity(s string) *integrityHash {
+	var best *integrityHash
+	rank := map[string]int{"sha1": 1, "sha256": 2, "sha384": 3, "sha512": 4}
+	for _, field := range strings.Fields(s) {
+		i := strings.Index(field, "-")
+		if i == -1 {
+			continue
+		}
+		alg, digest := field[:i], field[i+1:]
+		if j := strings.Index(digest, "?"); j != -1 {
+			digest = digest[:j]
+		}
+		sum, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			continue
+		}
+		var h hash.Hash
+		switch alg {
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		case "sha384":
+			h = sha512.New384()
+		case "sha512":
+			h = sha512.New()
+		default:
+			continue
+		}
+		if best == nil || rank[alg] > rank[best.alg] {
+			best = &integrityHash{alg: alg, h: h, sum: sum}
+		}
+	}
+	return best
+}
@@ -1,28 +1,89 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/bep/npmgoproxy/npmgop"
 )
 
 func main() {
-	server, err := npmgop.Start()
+	configFile := flag.String("config", "", "JSON file with the registry, auth and package policy settings, re-read on SIGHUP")
+	flag.Parse()
+
+	var opts npmgop.Options
+	if *configFile != "" {
+		cfg, err := npmgop.ReadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = cfg.Apply(opts)
+	}
+
+	if flag.Arg(0) == "validate" {
+		validate(opts, flag.Args()[1:])
+		return
+	}
+
+	server, err := npmgop.Start(opts)
 	if err != nil {
 		log.Fatal("failed to start proxy server:", err)
 	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
+	reload := make(chan os.Signal, 1)
+	if *configFile != "" {
+		signal.Notify(reload, syscall.SIGHUP)
+	}
 
-	fmt.Println("npmgoproxy running ...")
+	fmt.Printf("npmgoproxy running on %s ...\n", server.Addr())
 
-	<-stop
+loop:
+	for {
+		select {
+		case <-reload:
+			cfg, err := npmgop.ReadConfig(*configFile)
+			if err == nil {
+				err = server.Reload(cfg)
+			}
+			if err != nil {
+				log.Println("failed to reload config, keeping the current one:", err)
+			}
+		case <-stop:
+			break loop
+		}
+	}
 
 	if err := server.Shutdown(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// validate checks that the given npm packages, e.g. foo@1.2.3,
+// repack into valid Go modules.
+func validate(opts npmgop.Options, specs []string) {
+	if len(specs) == 0 {
+		log.Fatal("usage: npmgoproxy validate package[@version] ...")
+	}
+
+	failed := false
+	for _, spec := range specs {
+		result, err := npmgop.Validate(context.Background(), opts, spec)
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", spec, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("ok   %s: %s@%s (%d files)\n", spec, result.ModulePath, result.Version, result.Files)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+package npmgop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// BlobStore stores built module zips keyed by the shasum of the npm
+// tarball they're built from, prefixed with a hash of the module path and
+// the options changing the zips, e.g. in a bucket shared by several proxy
+// replicas, see Options.BlobStore. It must be safe for concurrent use.
+type BlobStore interface {
+	// Get opens the blob stored for key, failing with an error
+	// wrapping fs.ErrNotExist if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Put stores the blob read from r for key. Readers of key must see
+	// either the complete blob or none.
+	Put(ctx context.Context, key string, r io.Reader) error
+
+	// Exists reports whether a blob is stored for key.
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// Delete removes the blob stored for key, e.g. when purged, failing
+	// with an error wrapping fs.ErrNotExist if there is none.
+	Delete(ctx context.Context, key string) error
+}
+
+// DirBlobStore is a BlobStore storing the blobs as files in a directory,
+// which may be shared, e.g. on a network file system.
+type DirBlobStore struct {
+	dir string
+}
+
+// NewDirBlobStore returns a BlobStore storing the blobs in dir,
+// which is created when needed.
+func NewDirBlobStore(dir string) *DirBlobStore {
+	return &DirBlobStore{dir: dir}
+}
+
+func (s *DirBlobStore) filename(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Get opens the file stored for key.
+func (s *DirBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+// Put writes r to the file for key, see writeFileAtomic.
+func (s *DirBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, r)
+}
+
+// Exists reports whether the file for key exists.
+func (s *DirBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filename)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete removes the file for key.
+func (s *DirBlobStore) Delete(ctx context.Context, key string) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// getStoredZip opens the module zip for mctx of the tarball with shasum in
+// Options.BlobStore, if enabled and found there. Blobs without random
+// access, e.g. from remote stores, are copied to a temp file in
+// Options.WorkDir first. Blobs that aren't valid zips of the module, e.g.
+// written by a broken replica, are ignored.
+// The returned cleanup func must be called when done with the zip.
+func (g *npmGoModProxy) getStoredZip(ctx context.Context, mctx moduleContext, shasum string) (nameReadSeekCloser, func(), bool) {
+	key := g.zipKey(mctx, shasum)
+	if g.opts.BlobStore == nil || key == "" {
+		return nil, nil, false
+	}
+	f, cleanup, err := g.openStoredZip(ctx, key)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			g.logf(ctx, "warning: failed to get module zip %s from the blob store: %s", key, err)
+		}
+		return nil, nil, false
+	}
+	if _, err := modzip.CheckZip(module.Version{Path: mctx.modulePath(), Version: mctx.Version}, f.Name()); err != nil {
+		cleanup()
+		g.logf(ctx, "warning: ignoring invalid module zip %s in the blob store: %s", key, err)
+		return nil, nil, false
+	}
+	return f, cleanup, true
+}
+
+// openStoredZip opens the blob stored for key with random access.
+func (g *npmGoModProxy) openStoredZip(ctx context.Context, key string) (nameReadSeekCloser, func(), error) {
+	rc, err := g.opts.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Hashing and checking the zip needs random access.
+	if f, ok := rc.(interface {
+		nameReadSeekCloser
+		io.ReaderAt
+	}); ok {
+		return f, func() { f.Close() }, nil
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp(g.opts.WorkDir, "npmgoproxy-"+key+"*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return f, cleanup, nil
+}
+
+// storeZip puts the module zip for mctx in f, built from the tarball with
+// shasum, into Options.BlobStore, if enabled.
+func (g *npmGoModProxy) storeZip(ctx context.Context, mctx moduleContext, shasum string, f io.ReadSeeker) {
+	key := g.zipKey(mctx, shasum)
+	if g.opts.BlobStore == nil || key == "" {
+		return
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	if err == nil {
+		err = g.opts.BlobStore.Put(ctx, key, f)
+	}
+	if err != nil {
+		g.logf(ctx, "error: failed to store module zip %s: %s", key, err)
+	}
+}
+
+// zipStored reports whether the module zip for mctx of the tarball with
+// shasum is in Options.BlobStore.
+func (g *npmGoModProxy) zipStored(ctx context.Context, mctx moduleContext, shasum string) bool {
+	key := g.zipKey(mctx, shasum)
+	if g.opts.BlobStore == nil || key == "" {
+		return false
+	}
+	found, err := g.opts.BlobStore.Exists(ctx, key)
+	if err != nil {
+		g.logf(ctx, "warning: failed to look up module zip %s in the blob store: %s", key, err)
+	}
+	return found
+}
+
+// deleteStoredZips removes the module zips with keys, see zipKey, from
+// Options.BlobStore, if enabled. It reports whether any was removed.
+func (g *npmGoModProxy) deleteStoredZips(ctx context.Context, keys []string) bool {
+	if g.opts.BlobStore == nil {
+		return false
+	}
+	removed := false
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		err := g.opts.BlobStore.Delete(ctx, key)
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			g.logf(ctx, "error: failed to delete module zip %s from the blob store: %s", key, err)
+		}
+	}
+	return removed
+}
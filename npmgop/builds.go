@@ -0,0 +1,100 @@
+package npmgop
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// builds tracks the in-flight module zip builds, so shutdown
+// can wait for them to finish and clean up their temp dirs.
+type builds struct {
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+
+	// slots limits the number of zips repacked concurrently,
+	// see Options.MaxConcurrentZipBuilds.
+	slots chan struct{}
+}
+
+func newBuilds(maxConcurrent int) *builds {
+	if maxConcurrent <= 0 {
+		maxConcurrent = runtime.GOMAXPROCS(0)
+	}
+	return &builds{
+		cancels: make(map[int]context.CancelFunc),
+		slots:   make(chan struct{}, maxConcurrent),
+	}
+}
+
+// acquire waits for a free slot to repack a zip in, failing if ctx is done
+// first. release must be called when the zip is repacked.
+func (b *builds) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case b.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func() { <-b.slots }, nil
+}
+
+// start registers a build, returning a context that is cancelled if
+// the build is still running when wait gives up, and a func to call
+// when the build and its temp files are done with.
+func (b *builds) start(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.cancels[id] = cancel
+	b.mu.Unlock()
+	b.wg.Add(1)
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.cancels, id)
+			b.mu.Unlock()
+			cancel()
+			b.wg.Done()
+		})
+	}
+}
+
+// inFlight returns the number of builds running.
+func (b *builds) inFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.cancels)
+}
+
+// wait waits for the in-flight builds to finish. When ctx is done
+// first, the remaining builds are cancelled and waited for, which
+// makes them clean up their temp dirs.
+// It reports whether all builds finished in time.
+func (b *builds) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	for _, cancel := range b.cancels {
+		cancel()
+	}
+	b.mu.Unlock()
+	<-done
+	return false
+}
@@ -0,0 +1,276 @@
+package npmgop
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// zipCache is a disk cache of built module zips laid out like
+// a GOPROXY: $dir/$module/@v/$version.zip, with $module escaped.
+type zipCache struct {
+	dir string
+}
+
+func newZipCache(dir string) *zipCache {
+	if dir == "" {
+		return nil
+	}
+	return &zipCache{dir: dir}
+}
+
+func (c *zipCache) filename(mctx moduleContext) string {
+	return filepath.Join(c.dir, filepath.FromSlash(mctx.escapedModulePath()), "@v", mctx.Version+".zip")
+}
+
+// get opens the cached zip for mctx, if any.
+func (c *zipCache) get(mctx moduleContext) (*os.File, bool) {
+	if c == nil {
+		return nil, false
+	}
+	f, err := os.Open(c.filename(mctx))
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// put copies r into the cache for mctx.
+func (c *zipCache) put(mctx moduleContext, r io.Reader) error {
+	if c == nil {
+		return nil
+	}
+	filename := c.filename(mctx)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, r)
+}
+
+// writeFileAtomic writes r to a temp file next to filename and renames it
+// into place, so concurrent readers, also in other processes sharing the
+// cache dir, see either the complete file or none. Concurrent writers each
+// write their own temp file and the last rename wins.
+func writeFileAtomic(filename string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// contains reports whether a zip for mctx is cached.
+func (c *zipCache) contains(mctx moduleContext) bool {
+	if c == nil {
+		return false
+	}
+	_, err := os.Stat(c.filename(mctx))
+	return err == nil
+}
+
+// remove removes the cached zip for mctx.
+// It reports whether anything was removed.
+func (c *zipCache) remove(mctx moduleContext) bool {
+	if c == nil {
+		return false
+	}
+	os.Remove(c.hashFilename(mctx))
+	return os.Remove(c.filename(mctx)) == nil
+}
+
+// removeModule removes all cached zips for the module in mctx.
+// It reports whether anything was removed.
+func (c *zipCache) removeModule(mctx moduleContext) bool {
+	if c == nil {
+		return false
+	}
+	dir := filepath.Join(c.dir, filepath.FromSlash(mctx.escapedModulePath()), "@v")
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	return os.RemoveAll(dir) == nil
+}
+
+// zipOptions returns the options in opts changing the contents of the
+// module zips, for zipKey. Replicas sharing a BlobStore with different
+// Transform funcs must use different ModulePathBases, as funcs can't be
+// told apart.
+func zipOptions(opts Options) string {
+	return fmt.Sprintf("docgo=%t requiresource=%t casecollisions=%d include=%q exclude=%q transform=%t",
+		opts.DocGo, opts.RequireSource, opts.CaseCollisions, opts.IncludeFiles, opts.ExcludeFiles, opts.Transform != nil)
+}
+
+// zipKey returns the key the module zip for mctx, built from the tarball
+// with shasum, is cached and stored by: the shasum prefixed with a hash of
+// the module path and the options changing the zip contents, as the same
+// tarball may be published as several packages, and the replicas sharing
+// a BlobStore may be configured differently. It's empty if shasum is.
+func (g *npmGoModProxy) zipKey(mctx moduleContext, shasum string) string {
+	if shasum == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(mctx.modulePath() + "\n" + g.zipOptions))
+	return fmt.Sprintf("%x-%s", h[:8], shasum)
+}
+
+// memoryCache is a LRU cache of built module zips keyed by zipKey,
+// bounded by the total size of the zips. Entries are content addressed
+// and never invalidated, as the options in the key can't be changed by
+// Server.Reload. An empty key, e.g. for versions with only an integrity,
+// is never cached.
+type memoryCache struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+type memoryCacheEntry struct {
+	key     string
+	b       []byte
+	modTime time.Time
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &memoryCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *memoryCache) get(key string) (memoryCacheEntry, bool) {
+	if c == nil || key == "" {
+		return memoryCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		c.misses++
+		return memoryCacheEntry{}, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(memoryCacheEntry), true
+}
+
+// contains reports whether key is cached without affecting the LRU order or stats.
+func (c *memoryCache) contains(key string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.entries[key]
+	return found
+}
+
+// put adds b to the cache if it fits, evicting the least recently used entries as needed.
+func (c *memoryCache) put(key string, b []byte, modTime time.Time) {
+	if c == nil || key == "" || int64(len(b)) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[key]; found {
+		return
+	}
+	for c.size+int64(len(b)) > c.maxSize {
+		el := c.lru.Back()
+		e := el.Value.(memoryCacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.b))
+	}
+	c.entries[key] = c.lru.PushFront(memoryCacheEntry{key: key, b: b, modTime: modTime})
+	c.size += int64(len(b))
+}
+
+// usage returns the number of cached zips and their total size.
+func (c *memoryCache) usage() (entries int, size int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
+
+func (c *memoryCache) stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// invalidVersions records the package versions that failed to repack
+// as valid Go modules, see Options.ValidatedList.
+type invalidVersions struct {
+	mu       sync.Mutex
+	packages map[string]map[string]bool
+}
+
+func newInvalidVersions() *invalidVersions {
+	return &invalidVersions{packages: make(map[string]map[string]bool)}
+}
+
+func (iv *invalidVersions) add(pkg, version string) {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+	if iv.packages[pkg] == nil {
+		iv.packages[pkg] = make(map[string]bool)
+	}
+	iv.packages[pkg][version] = true
+}
+
+func (iv *invalidVersions) contains(pkg, version string) bool {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+	return iv.packages[pkg][version]
+}
+
+// remove forgets version of pkg, or all versions if version is empty.
+// It reports whether anything was removed.
+func (iv *invalidVersions) remove(pkg, version string) bool {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+	versions, found := iv.packages[pkg]
+	if !found {
+		return false
+	}
+	if version == "" {
+		delete(iv.packages, pkg)
+		return true
+	}
+	found = versions[version]
+	delete(versions, version)
+	return found
+}
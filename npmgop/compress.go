@@ -0,0 +1,105 @@
+package npmgop
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// compressHandler compresses responses for clients accepting gzip or deflate.
+// Module zips and npm tarballs are already compressed and are passed through as is.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || strings.HasSuffix(r.URL.Path, ".zip") || strings.HasSuffix(r.URL.Path, ".tgz") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding returns the preferred supported encoding in the
+// Accept-Encoding header value s, or an empty string if none.
+func acceptedEncoding(s string) string {
+	var deflate bool
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		name, params := part, ""
+		if i := strings.Index(part, ";"); i != -1 {
+			name, params = strings.TrimSpace(part[:i]), strings.ReplaceAll(part[i+1:], " ", "")
+		}
+		if params == "q=0" || params == "q=0.0" {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+	if deflate {
+		return "deflate"
+	}
+	return ""
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	w           io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		if w.encoding == "gzip" {
+			w.w = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.w, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.w == nil {
+		return 0, http.ErrBodyNotAllowed
+	}
+	return w.w.Write(b)
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,96 @@
+package npmgop
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bep/npmgoproxy/internal"
+)
+
+// Config holds the registry, auth and package policy settings, which,
+// unlike the rest of Options, can be changed on a running server with
+// Server.Reload. The fields are as in Options.
+type Config struct {
+	Registry           string
+	FallbackRegistries []string
+	RegistryOverrides  []RegistryOverride
+	AuthTokens         map[string]string
+	AllowPackages      []string
+	DenyPackages       []string
+}
+
+// ReadConfig reads a Config from the JSON file filename, with the
+// field names as keys, e.g. {"Registry": "https://npm.example.org"}.
+func ReadConfig(filename string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode config %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// Apply returns opts with the settings in cfg.
+func (cfg Config) Apply(opts Options) Options {
+	opts.Registry = cfg.Registry
+	opts.FallbackRegistries = cfg.FallbackRegistries
+	opts.RegistryOverrides = cfg.RegistryOverrides
+	opts.AuthTokens = cfg.AuthTokens
+	opts.AllowPackages = cfg.AllowPackages
+	opts.DenyPackages = cfg.DenyPackages
+	return opts
+}
+
+// Reload replaces the registry, auth and package policy settings of the
+// running server with the ones in cfg, without dropping the connections
+// or requests in flight, which may still use the old settings. The limit
+// of concurrent registry requests holds across the reload. The metadata
+// cache is kept unless the registries change, as the packages may come
+// from another registry then, while the zip caches, keyed by the tarball
+// shasums, are always kept.
+func (s *Server) Reload(cfg Config) error {
+	g := s.proxy
+
+	policy, err := newPackagePolicy(cfg.AllowPackages, cfg.DenyPackages)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	opts := cfg.Apply(g.applied)
+	g.client = g.client.Reconfigure(clientOptions(opts))
+	g.policy = policy
+	g.applied = opts
+	g.mu.Unlock()
+
+	registries := append([]string{cfg.Registry}, cfg.FallbackRegistries...)
+	if cfg.Registry == "" {
+		registries[0] = internal.DefaultRegistry
+	}
+	g.logf(context.Background(), "npmgomodproxy.reload registries=%s", strings.Join(registries, ","))
+
+	return nil
+}
+
+// currentClient returns the registry client, replaced by Server.Reload.
+func (g *npmGoModProxy) currentClient() *internal.Client {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.client
+}
+
+// currentPolicy returns the package policy, replaced by Server.Reload.
+func (g *npmGoModProxy) currentPolicy() *packagePolicy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.policy
+}
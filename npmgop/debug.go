@@ -0,0 +1,80 @@
+package npmgop
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bep/npmgoproxy/internal"
+)
+
+// maxRecentErrors is the number of errors kept for the debug endpoint.
+const maxRecentErrors = 20
+
+// debugVars is the JSON served at /debug/vars on Options.DebugAddr.
+type debugVars struct {
+	Stats
+
+	MemoryCacheEntries int
+	MemoryCacheSize    int64 // total size in bytes of the zips in memory
+	CachedPackages     int   // package documents in the metadata cache
+	BuildsInFlight     int
+	RecentErrors       []recentError // newest last
+}
+
+type recentError struct {
+	Time      time.Time
+	RequestID string `json:",omitempty"`
+	Status    int
+	Message   string
+}
+
+// recentErrors keeps the last maxRecentErrors errors responded with.
+type recentErrors struct {
+	mu     sync.Mutex
+	errors []recentError
+}
+
+func (e *recentErrors) add(ctx context.Context, status int, msg string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.errors) == maxRecentErrors {
+		e.errors = append(e.errors[:0], e.errors[1:]...)
+	}
+	e.errors = append(e.errors, recentError{Time: time.Now(), RequestID: internal.RequestID(ctx), Status: status, Message: msg})
+}
+
+func (e *recentErrors) list() []recentError {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]recentError(nil), e.errors...)
+}
+
+// debugHandler serves the proxy's internals at /debug/vars.
+func (s *Server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		g := s.proxy
+		vars := debugVars{
+			Stats:          s.Stats(),
+			CachedPackages: g.currentClient().CachedPackages(),
+			BuildsInFlight: g.builds.inFlight(),
+			RecentErrors:   g.errors.list(),
+		}
+		vars.MemoryCacheEntries, vars.MemoryCacheSize = g.memzips.usage()
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(vars)
+	})
+	return mux
+}
@@ -0,0 +1,50 @@
+package npmgop
+
+import "github.com/bep/npmgoproxy/internal"
+
+// The errors returned by Validate wrap these, to be checked with errors.Is.
+var (
+	// ErrPackageNotFound is returned for packages the registry doesn't know about.
+	ErrPackageNotFound = internal.ErrPackageNotFound
+
+	// ErrUppercasePackageName wraps ErrPackageNotFound for packages with
+	// uppercase letters in their names, which npm no longer allows.
+	ErrUppercasePackageName = internal.ErrUppercasePackageName
+
+	// ErrVersionNotFound is returned for versions the registry doesn't know about.
+	ErrVersionNotFound = internal.ErrVersionNotFound
+
+	// ErrVersionUnpublished is returned for versions that have been unpublished from the registry.
+	ErrVersionUnpublished = internal.ErrVersionUnpublished
+
+	// ErrRegistryUnavailable is returned when the registry can't be reached
+	// or fails with a server error.
+	ErrRegistryUnavailable = internal.ErrRegistryUnavailable
+
+	// ErrRegistryUnauthorized is returned when the registry denies access,
+	// e.g. to private packages without a valid auth token.
+	ErrRegistryUnauthorized = internal.ErrRegistryUnauthorized
+
+	// ErrOffline is returned for anything not cached, see Options.Offline.
+	ErrOffline = internal.ErrOffline
+
+	// ErrShasumMismatch is returned for tarballs not matching their shasum.
+	ErrShasumMismatch = internal.ErrShasumMismatch
+
+	// ErrIntegrityMismatch is returned for tarballs not matching their integrity hash.
+	ErrIntegrityMismatch = internal.ErrIntegrityMismatch
+
+	// ErrMissingChecksum is returned for tarballs without the checksums
+	// required by the Verification policy.
+	ErrMissingChecksum = internal.ErrMissingChecksum
+
+	// ErrTarballTooLarge is returned for tarballs larger than Options.MaxTarballSize.
+	ErrTarballTooLarge = internal.ErrTarballTooLarge
+
+	// ErrNoSource is returned for packages with nothing but package metadata,
+	// see Options.RequireSource.
+	ErrNoSource = internal.ErrNoSource
+
+	// ErrInvalidModule is returned for packages that can't be repacked as valid Go modules.
+	ErrInvalidModule = internal.ErrInvalidModule
+)
@@ -0,0 +1,130 @@
+package npmgop
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/bep/npmgoproxy/internal"
+)
+
+// infoField is an optional field of the .info responses.
+type infoField struct {
+	name    string
+	enabled func(opts Options) bool
+
+	// value returns the field's value for v, false to leave it out,
+	// e.g. for a version without a bin field.
+	value func(v internal.Version) (interface{}, bool)
+}
+
+// infoFields are the optional fields of the .info responses, in order.
+var infoFields = []infoField{
+	{
+		name:    "Origin",
+		enabled: func(opts Options) bool { return opts.InfoOrigin },
+		value: func(v internal.Version) (interface{}, bool) {
+			return versionOrigin{Shasum: v.Dist.ShaSum, Integrity: v.Dist.Integrity, Tarball: v.Dist.Tarball}, true
+		},
+	},
+	{
+		name:    "Bin",
+		enabled: func(opts Options) bool { return opts.InfoBin },
+		value: func(v internal.Version) (interface{}, bool) {
+			return v.Bin, len(v.Bin) > 0
+		},
+	},
+	{
+		name:    "Engines",
+		enabled: func(opts Options) bool { return opts.InfoEngines },
+		value: func(v internal.Version) (interface{}, bool) {
+			return v.Engines, len(v.Engines) > 0
+		},
+	},
+	{
+		name:    "Deprecated",
+		enabled: func(opts Options) bool { return opts.InfoDeprecated },
+		value: func(v internal.Version) (interface{}, bool) {
+			return string(v.Deprecated), v.Deprecated != ""
+		},
+	},
+	{
+		name:    "Repository",
+		enabled: func(opts Options) bool { return opts.InfoRepository },
+		value: func(v internal.Version) (interface{}, bool) {
+			if v.Repository == nil || v.Repository.URL == "" {
+				return nil, false
+			}
+			return versionRepository{Type: v.Repository.Type, URL: v.Repository.URL, Directory: v.Repository.Directory}, true
+		},
+	},
+	{
+		name:    "Types",
+		enabled: func(opts Options) bool { return opts.InfoTypes },
+		value: func(v internal.Version) (interface{}, bool) {
+			return v.Types, v.Types != ""
+		},
+	},
+}
+
+// enabledInfoFields returns the optional .info fields enabled in opts.
+func enabledInfoFields(opts Options) []infoField {
+	var fields []infoField
+	for _, f := range infoFields {
+		if f.enabled(opts) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// encodeVersion writes the .info response for version, published at
+// published: the Version, the Time if known and the enabled infoFields.
+func (g *npmGoModProxy) encodeVersion(w io.Writer, version internal.Version, published time.Time) {
+	var buf bytes.Buffer
+	writeField := func(name string, value interface{}) {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return
+		}
+		if buf.Len() == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(name))
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+
+	writeField("Version", version.Version)
+	// The publish time is only known with Options.FullMetadata. The go
+	// command treats a missing Time as unknown, a zero one would be wrong.
+	if !published.IsZero() {
+		writeField("Time", published.UTC())
+	}
+	for _, f := range g.infoFields {
+		if value, ok := f.value(version); ok {
+			writeField(f.name, value)
+		}
+	}
+	buf.WriteString("}\n")
+
+	w.Write(buf.Bytes())
+}
+
+// versionRepository is the npm source repository of a version.
+type versionRepository struct {
+	Type      string `json:",omitempty"`
+	URL       string
+	Directory string `json:",omitempty"`
+}
+
+// versionOrigin describes the npm tarball a module zip was built from.
+type versionOrigin struct {
+	Shasum    string `json:",omitempty"`
+	Integrity string `json:",omitempty"`
+	Tarball   string `json:",omitempty"`
+}
@@ -0,0 +1,39 @@
+package npmgop
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bep/npmgoproxy/internal"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// ModulePath returns the Go module path the proxy serves version of the npm
+// package npmName as with the default Options.ModulePathBase, e.g.
+// gohugo.io/npmjs/___vue/reactivity/v3 for @vue/reactivity 3.4.0.
+// The version may be given with or without the v prefix.
+func ModulePath(npmName, version string) (string, error) {
+	return Options{}.ModulePath(npmName, version)
+}
+
+// ModulePath is like the ModulePath func, but for a proxy started with
+// opts, e.g. npm.example.org/alpinejs with ModulePathBase npm.example.org.
+func (opts Options) ModulePath(npmName, version string) (string, error) {
+	if npmName == "" {
+		return "", fmt.Errorf("empty npm package name")
+	}
+	v := "v" + strings.TrimPrefix(version, "v")
+	if !semver.IsValid(v) {
+		return "", fmt.Errorf("invalid version %q for npm package %q", version, npmName)
+	}
+	base := opts.ModulePathBase
+	if base == "" {
+		base = internal.ModPathBase
+	}
+	p := internal.VersionModulePath(base, npmName, v)
+	if err := module.CheckPath(p); err != nil {
+		return "", fmt.Errorf("npm package %q: %w", npmName, err)
+	}
+	return p, nil
+}
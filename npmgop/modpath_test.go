@@ -0,0 +1,54 @@
+package npmgop
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestModulePath(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name    string
+		version string
+		path    string
+	}{
+		{"alpinejs", "1.2.3", "gohugo.io/npmjs/alpinejs"},
+		{"alpinejs", "v0.1.0", "gohugo.io/npmjs/alpinejs"},
+		{"alpinejs", "2.0.0-beta.1", "gohugo.io/npmjs/alpinejs/v2"},
+		{"@vue/reactivity", "3.4.0", "gohugo.io/npmjs/___vue/reactivity/v3"},
+		{"@vue/reactivity", "1.0.0", "gohugo.io/npmjs/___vue/reactivity"},
+		{"foo___bar", "1.0.0", "gohugo.io/npmjs/foo___bar"},
+	} {
+		p, err := ModulePath(test.name, test.version)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p, qt.Equals, test.path)
+	}
+
+	_, err := ModulePath("", "1.0.0")
+	c.Assert(err, qt.ErrorMatches, "empty npm package name")
+	_, err = ModulePath("alpinejs", "latest")
+	c.Assert(err, qt.ErrorMatches, `invalid version "latest" for npm package "alpinejs"`)
+	_, err = ModulePath("foo bar", "1.0.0")
+	c.Assert(err, qt.ErrorMatches, `npm package "foo bar": .*`)
+}
+
+func TestOptionsModulePath(t *testing.T) {
+	c := qt.New(t)
+
+	opts := Options{ModulePathBase: "npm.example.org"}
+	p, err := opts.ModulePath("@vue/reactivity", "3.4.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p, qt.Equals, "npm.example.org/___vue/reactivity/v3")
+	p, err = opts.ModulePath("alpinejs", "v1.0.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p, qt.Equals, "npm.example.org/alpinejs")
+
+	p, err = Options{}.ModulePath("alpinejs", "1.0.0")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p, qt.Equals, "gohugo.io/npmjs/alpinejs")
+
+	_, err = opts.ModulePath("alpinejs", "latest")
+	c.Assert(err, qt.ErrorMatches, `invalid version "latest" for npm package "alpinejs"`)
+}
@@ -0,0 +1,45 @@
+package npmgop
+
+import (
+	"fmt"
+	"path"
+)
+
+// packagePolicy decides which npm packages are served,
+// see Options.AllowPackages and Options.DenyPackages.
+type packagePolicy struct {
+	allow []string
+	deny  []string
+}
+
+func newPackagePolicy(allow, deny []string) (*packagePolicy, error) {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid package pattern %q: %w", pattern, err)
+		}
+	}
+	return &packagePolicy{allow: allow, deny: deny}, nil
+}
+
+// check returns an error if the npm package pkg may not be served.
+func (p *packagePolicy) check(pkg string) error {
+	if p == nil {
+		return nil
+	}
+	if matchPackage(p.deny, pkg) {
+		return fmt.Errorf("npm package %q is denied by the proxy's package policy", pkg)
+	}
+	if len(p.allow) > 0 && !matchPackage(p.allow, pkg) {
+		return fmt.Errorf("npm package %q is not allowed by the proxy's package policy", pkg)
+	}
+	return nil
+}
+
+func matchPackage(patterns []string, pkg string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, pkg); ok {
+			return true
+		}
+	}
+	return false
+}
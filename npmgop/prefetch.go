@@ -0,0 +1,120 @@
+package npmgop
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bep/npmgoproxy/internal"
+	"golang.org/x/mod/semver"
+)
+
+// maxPrefetches is the maximum number of module zips prefetched
+// concurrently, see Options.PrefetchOnList. More are skipped.
+const maxPrefetches = 4
+
+// prefetches tracks the module zips being prefetched, keyed by
+// package and version, so zip requests can wait for them.
+type prefetches struct {
+	mu      sync.Mutex
+	running map[string]chan struct{}
+}
+
+func newPrefetches() *prefetches {
+	return &prefetches{running: make(map[string]chan struct{})}
+}
+
+// start registers a prefetch for key, reporting false if it's already
+// running or maxPrefetches are. done must be called when it's finished.
+func (p *prefetches) start(key string) (done func(), ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.running[key]; found || len(p.running) >= maxPrefetches {
+		return nil, false
+	}
+	ch := make(chan struct{})
+	p.running[key] = ch
+	return func() {
+		p.mu.Lock()
+		delete(p.running, key)
+		p.mu.Unlock()
+		close(ch)
+	}, true
+}
+
+// wait waits for the prefetch for key, if any, to finish or ctx to be done.
+func (p *prefetches) wait(ctx context.Context, key string) {
+	p.mu.Lock()
+	ch, found := p.running[key]
+	p.mu.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+}
+
+// prefetchKey returns the prefetches key for version of the package in mctx.
+func prefetchKey(mctx moduleContext, version string) string {
+	return mctx.NpmPackage + "@" + version
+}
+
+// prefetchLatest starts building the module zip of the highest release
+// version, if any, else the highest version, in the listed versions,
+// which the go command usually fetches right after the list.
+func (g *npmGoModProxy) prefetchLatest(mctx moduleContext, versions []string) {
+	if len(versions) == 0 || !g.cachesZips() {
+		return
+	}
+	latest := versions[len(versions)-1]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if semver.Prerelease(versions[i]) == "" {
+			latest = versions[i]
+			break
+		}
+	}
+
+	done, ok := g.prefetches.start(prefetchKey(mctx, latest))
+	if !ok {
+		return
+	}
+	mctx.Version = latest
+
+	// Shutdown waits for, or cancels, the prefetch like any build.
+	ctx, buildDone := g.builds.start(context.Background())
+	go func() {
+		defer done()
+		defer buildDone()
+		npmv, err := g.fetchVersion(ctx, &mctx)
+		if err == nil {
+			err = g.warm(ctx, mctx, npmv)
+		}
+		if err != nil {
+			g.logf(ctx, "warning: failed to prefetch %s@%s: %s", mctx.NpmPackage, latest, err)
+		}
+	}()
+}
+
+// warm builds the module zip of npmv into the caches, unless it's cached already.
+func (g *npmGoModProxy) warm(ctx context.Context, mctx moduleContext, npmv internal.Version) error {
+	// The zip handler serves it from any of them without building it.
+	if g.memzips.contains(g.zipKey(mctx, npmv.Dist.ShaSum)) || g.zipStored(ctx, mctx, npmv.Dist.ShaSum) || g.zips.contains(mctx) {
+		return nil
+	}
+
+	f, cleanup, err := g.buildZip(ctx, mctx, npmv)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	g.memorizeZip(mctx, npmv, f)
+
+	return nil
+}
+
+// cachesZips reports whether any of the module zip caches is enabled.
+func (g *npmGoModProxy) cachesZips() bool {
+	return g.zips != nil || g.memzips != nil || g.opts.BlobStore != nil
+}
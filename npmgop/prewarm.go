@@ -0,0 +1,85 @@
+package npmgop
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bep/npmgoproxy/internal"
+)
+
+// prewarmWorkers is the number of packages prewarmed concurrently.
+const prewarmWorkers = 4
+
+// Prewarm fetches the metadata for the given npm packages into the metadata cache
+// and, if a zip cache is enabled, builds the module zip for the latest version
+// of each package. It returns an error listing all packages that failed.
+func (s *Server) Prewarm(ctx context.Context, packages []string) error {
+	g := s.proxy
+
+	jobs := make(chan string)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errors []string
+	)
+
+	for i := 0; i < prewarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range jobs {
+				if err := g.prewarm(ctx, pkg); err != nil {
+					mu.Lock()
+					errors = append(errors, fmt.Sprintf("%s: %s", pkg, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var err error
+loop:
+	for _, pkg := range packages {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case jobs <- pkg:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("failed to prewarm %d package(s): %s", len(errors), strings.Join(errors, "; "))
+	}
+
+	return err
+}
+
+func (g *npmGoModProxy) prewarm(ctx context.Context, pkg string) error {
+	npmpkg, err := g.currentClient().FetchPackage(ctx, pkg)
+	if err != nil {
+		return err
+	}
+
+	if !g.cachesZips() {
+		return nil
+	}
+
+	npmv, found := npmpkg.ByVersion(npmpkg.DistTags.Latest)
+	if !found {
+		return fmt.Errorf("latest version %q not found", npmpkg.DistTags.Latest)
+	}
+
+	mctx := moduleContext{
+		ModulePathBase:   g.opts.ModulePathBase,
+		NpmPackage:       pkg,
+		Version:          npmv.Version,
+		PathMajorVersion: internal.PathMajor(npmv.Version),
+	}
+
+	return g.warm(ctx, mctx, npmv)
+}
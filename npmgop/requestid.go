@@ -0,0 +1,35 @@
+package npmgop
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/bep/npmgoproxy/internal"
+)
+
+// validRequestIDRe matches inbound request IDs safe to log and propagate.
+var validRequestIDRe = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// requestIDHandler tags each request with a request ID, either the one in
+// the inbound X-Request-ID header or a generated one. The ID is echoed in
+// the response, prefixed to log lines and propagated to the registry.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(internal.RequestIDHeader)
+		if !validRequestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(internal.RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(internal.WithRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
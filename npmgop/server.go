@@ -1,46 +1,504 @@
 package npmgop
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bep/npmgoproxy/internal"
 
+	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-const npmjsPrefix = internal.ModPathBase + "/"
-
 var (
-	apiList = regexp.MustCompile(`^/(?P<module>.*)/@v/list$`)
-	apiInfo = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).info$`)
-	apiMod  = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).mod$`)
-	apiZip  = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).zip$`)
+	apiList    = regexp.MustCompile(`^/(?P<module>.*)/@v/list$`)
+	apiTags    = regexp.MustCompile(`^/(?P<module>.*)/@v/tags$`)
+	apiInfo    = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).info$`)
+	apiMod     = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).mod$`)
+	apiZip     = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).zip$`)
+	apiZipHash = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).ziphash$`)
+	apiTarball = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).tgz$`)
+)
+
+// Verification is the policy used to verify downloaded tarballs.
+type Verification = internal.Verification
+
+const (
+	// VerifyPreferIntegrity verifies the Subresource Integrity hash when available,
+	// falling back to the SHA-1 shasum.
+	VerifyPreferIntegrity = internal.VerifyPreferIntegrity
+
+	// VerifyStrict verifies both the shasum and the integrity hash when available,
+	// falling back to the integrity hash when the shasum is missing.
+	VerifyStrict = internal.VerifyStrict
+
+	// VerifySkipOnMissing is like VerifyPreferIntegrity, but skips
+	// verification for versions without any checksum, logging a warning.
+	VerifySkipOnMissing = internal.VerifySkipOnMissing
 )
 
-func Start() (*Server, error) {
-	l, err := net.Listen("tcp", "localhost:8072")
+// PathEscaping is the scheme used to escape npm package names in Go module paths.
+type PathEscaping = internal.PathEscaping
+
+const (
+	// EscapeScope escapes the @ starting scoped package names as ___,
+	// e.g. ___vue/reactivity for @vue/reactivity, keeping the rest of the name.
+	// This is reversible and collision-free, as npm package names can't
+	// start with an underscore.
+	EscapeScope = internal.EscapeScope
+
+	// EscapeLegacy unescapes every ___ in module paths as @,
+	// which e.g. maps foo___bar to foo@bar.
+	EscapeLegacy = internal.EscapeLegacy
+)
+
+// CaseCollisionPolicy decides what to do with package files
+// whose paths differ only in case.
+type CaseCollisionPolicy = internal.CaseCollisionPolicy
+
+const (
+	// CaseCollisionFail fails the build with an error naming both paths.
+	CaseCollisionFail = internal.CaseCollisionFail
+
+	// CaseCollisionSkip keeps the first file in the tarball and skips the others.
+	CaseCollisionSkip = internal.CaseCollisionSkip
+)
+
+// Version is a npm package version as fetched from the registry.
+type Version = internal.Version
+
+// TransformFunc modifies the files of a npm package version extracted
+// to dir before they're packed as a module zip, see Options.Transform.
+type TransformFunc = internal.TransformFunc
+
+// RegistryOverride routes the packages with a name prefix to a registry.
+type RegistryOverride = internal.RegistryOverride
+
+// DefaultGoVersion is the default go directive in generated go.mod
+// files, see Options.GoVersion.
+const DefaultGoVersion = "1.21"
+
+// Options configures the proxy server.
+type Options struct {
+	// Addr is the TCP address to listen on, e.g. localhost:8072,
+	// [::1]:8072 for an IPv6 address or :8072 for all addresses.
+	// Port 0 picks a free port, see Server.TCPAddr.
+	// Defaults to localhost:8072.
+	Addr string
+
+	// Registry is the base URL of the npm registry.
+	// Defaults to https://registry.npmjs.org.
+	Registry string
+
+	// FallbackRegistries are npm registries tried in order when the
+	// ones before can't be reached or fail with a server error.
+	FallbackRegistries []string
+
+	// RegistryOverrides serves the packages matching one of the
+	// name prefixes, e.g. @mycorp/, from another registry.
+	RegistryOverrides []RegistryOverride
+
+	// AllowPackages, if set, limits the npm packages served to the ones
+	// matching one of the patterns, in path.Match syntax, e.g. alpinejs
+	// or @mycorp/*. Note that * doesn't match the / in scoped packages.
+	// Other packages get a 403 Forbidden.
+	AllowPackages []string
+
+	// DenyPackages are patterns, as in AllowPackages, of npm packages
+	// that get a 403 Forbidden. It takes precedence over AllowPackages.
+	DenyPackages []string
+
+	// ModulePathBase is the module path the npm packages are served below.
+	// Defaults to gohugo.io/npmjs. Set it to the proxy's host, e.g.
+	// npm.example.org, to serve the packages at the host's root, so
+	// they can be fetched as e.g. npm.example.org/alpinejs.
+	ModulePathBase string
+
+	// ModulePathEscaping is how npm package names are unescaped from the
+	// requested module paths. Defaults to EscapeScope. Both schemes give the
+	// same module paths for valid npm package names, EscapeLegacy only keeps
+	// the old handling of paths with ___ in them.
+	ModulePathEscaping PathEscaping
+
+	// URLHosts are the hosts, e.g. github.com, packages given as tarball
+	// or GitHub git URLs may be fetched from by Validate, with https only,
+	// also when redirected. Empty disables them.
+	URLHosts []string
+
+	// MetadataTTL is how long package documents fetched from the registry
+	// are cached in memory. Zero disables the metadata cache.
+	MetadataTTL time.Duration
+
+	// MetadataTTLJitter spreads the expiry of each cached package document
+	// randomly by up to this fraction of MetadataTTL either way, e.g. 0.1
+	// for ±10%, so popular packages fetched together don't expire at once.
+	MetadataTTLJitter float64
+
+	// MetadataStaleWhileRevalidate is how long package documents are still
+	// served after MetadataTTL, e.g. with an outdated latest dist-tag, while
+	// they're fetched again in the background.
+	MetadataStaleWhileRevalidate time.Duration
+
+	// MetadataTimeout limits the time to fetch a npm package or version
+	// document from the registry. Defaults to 30 seconds.
+	MetadataTimeout time.Duration
+
+	// TarballTimeout limits the time to download a npm tarball.
+	// Defaults to 5 minutes.
+	TarballTimeout time.Duration
+
+	// CacheDir is the directory to cache built module zips in.
+	// Empty disables the zip cache.
+	CacheDir string
+
+	// BlobStore, if set, stores the built module zips keyed by the npm
+	// tarball's shasum, e.g. in a bucket shared by several replicas, so
+	// a zip gets built once for all of them. Replicas configured to build
+	// different zips, e.g. with DocGo, store them under different keys. It's looked up after the
+	// memory cache and before CacheDir. See NewDirBlobStore.
+	BlobStore BlobStore
+
+	// MetadataCacheDir, if set, is the directory the npm package documents
+	// fetched from the registry are stored in, so they survive restarts.
+	// They're loaded from there while younger than MetadataTTL, or
+	// regardless of their age Offline.
+	MetadataCacheDir string
+
+	// Offline serves only what's in CacheDir and MetadataCacheDir, e.g. in
+	// air-gapped CI with caches populated before, without any requests to
+	// the registry. Anything else gets a 404 Not Found.
+	Offline bool
+
+	// MemoryCacheSize is the maximum total size in bytes of built module zips
+	// kept in memory, keyed by the npm tarball's shasum. Zero disables the memory cache.
+	MemoryCacheSize int64
+
+	// Verification is the policy used to verify tarballs downloaded
+	// from the registry. Defaults to VerifyPreferIntegrity.
+	Verification Verification
+
+	// CaseCollisions decides what to do with npm package files whose
+	// paths differ only in case, which Go module zips don't allow.
+	// Defaults to CaseCollisionFail.
+	CaseCollisions CaseCollisionPolicy
+
+	// MaxConcurrentRequests limits the number of concurrent requests to the
+	// npm registry, including tarball downloads. Defaults to 16.
+	MaxConcurrentRequests int
+
+	// MaxConcurrentZipBuilds limits the number of module zips built
+	// concurrently, which means holding the tarball and the repacked zip
+	// in memory or temp files. Requests above the limit wait for a free
+	// slot. Defaults to GOMAXPROCS.
+	MaxConcurrentZipBuilds int
+
+	// MaxTarballSize is the maximum size in bytes of npm tarballs
+	// to download. Defaults to 128 MB.
+	MaxTarballSize int64
+
+	// MaxPathLength and MaxPathDepth limit the length and the directory
+	// nesting of the file paths in npm tarballs, which are rejected when
+	// exceeding them. Default to 1024 bytes and 64 levels.
+	MaxPathLength int
+	MaxPathDepth  int
+
+	// MaxInMemorySize is the size in bytes up to which npm tarballs are
+	// repacked in memory instead of on disk. Zero always uses disk.
+	MaxInMemorySize int64
+
+	// WorkDir is where npm tarballs are downloaded and repacked, e.g. a
+	// large volume when the OS temp dir is a small tmpfs.
+	// Defaults to the OS temp dir.
+	WorkDir string
+
+	// RequireSource rejects npm packages without any files besides
+	// package metadata and docs, e.g. package.json, *.md files and dot
+	// files, as in deprecated placeholders, instead of
+	// serving an empty Go module.
+	RequireSource bool
+
+	// DocGo adds a generated doc.go with a package comment naming the npm
+	// package and version to the module zips, so go doc and module viewers
+	// have a Go package to show. This changes the zip hashes, so it must
+	// not be toggled for modules already recorded in go.sum files.
+	DocGo bool
+
+	// IncludeFiles, if set, limits the npm package files in the module zips
+	// to the ones matching one of the patterns, in path.Match syntax, e.g.
+	// dist/ or *.js. Patterns with a slash match from the package root,
+	// others match a name at any depth. The package.json is always included.
+	// Like DocGo, this changes the zip hashes.
+	IncludeFiles []string
+
+	// ExcludeFiles are patterns, as in IncludeFiles, of npm package files
+	// left out of the module zips, e.g. test/ or *.map.
+	ExcludeFiles []string
+
+	// Transform, if set, is called with the directory each npm package
+	// version is extracted to before it's packed as a module zip, with the
+	// package files below package/, e.g. to add a go.mod or patch files.
+	// An error from it fails the build. Like DocGo, this changes the zip hashes.
+	Transform TransformFunc
+
+	// FullMetadata fetches the full npm package documents, which include
+	// publish times, instead of the abbreviated ones. Without them, the
+	// .info responses have no Time.
+	FullMetadata bool
+
+	// AuthTokens maps hosts, e.g. npm.example.org, to bearer tokens
+	// sent with requests to the registries and tarball hosts.
+	AuthTokens map[string]string
+
+	// Transport is used for all requests to the npm registry and tarball
+	// hosts. Defaults to http.DefaultTransport, which honors the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Transport http.RoundTripper
+
+	// Logger is used for all logging, with lines for requests prefixed
+	// with their request ID. Defaults to plain lines on stdout.
+	Logger *log.Logger
+
+	// UserAgent is sent with all requests to the npm registry.
+	// Defaults to npmgoproxy/<version>.
+	UserAgent string
+
+	// Contact, e.g. a URL or email address, is appended to the User-Agent
+	// so registry operators know who to contact about this proxy.
+	Contact string
+
+	// DependencyOverrides replaces the version ranges of npm dependencies
+	// in the generated go.mod files, keyed by package name, e.g. to pin
+	// {"react": "17.0.2"} across packages depending on different majors.
+	// An empty range excludes the dependency.
+	DependencyOverrides map[string]string
+
+	// WithoutDependencies serves flat modules, with go.mod files without
+	// any requires regardless of the declared npm dependencies, for when
+	// the dependencies are managed elsewhere.
+	WithoutDependencies bool
+
+	// Shrinkwrap requires the npm dependency versions pinned by the
+	// npm-shrinkwrap.json or package-lock.json in the package, if any,
+	// in the generated go.mod files instead of resolving their ranges.
+	// Dependencies not in the lockfile are resolved as usual, and
+	// DependencyOverrides take precedence. The tarballs of versions not
+	// flagged as without shrinkwrap in the metadata are downloaded for it.
+	Shrinkwrap bool
+
+	// GoVersion is the go directive in the generated go.mod files.
+	// Defaults to DefaultGoVersion.
+	GoVersion string
+
+	// Toolchain, e.g. go1.21.0, adds a toolchain directive
+	// to the generated go.mod files. Empty leaves it out.
+	Toolchain string
+
+	// PeerDependencies includes the npm peerDependencies in the
+	// generated go.mod. Peer dependencies are expected to be provided
+	// by the consumer, so they're left out by default.
+	PeerDependencies bool
+
+	// ValidatedList leaves the versions that failed to repack as valid
+	// Go modules, e.g. because of invalid file names, out of the list
+	// responses, so the go command doesn't pick them. Versions are
+	// validated lazily, when their zip is first built.
+	ValidatedList bool
+
+	// MaxListVersions limits the list responses to the highest
+	// MaxListVersions release versions, leaving out pre-releases.
+	// Older versions can still be fetched directly. Zero means no limit.
+	MaxListVersions int
+
+	// InfoOrigin adds an Origin field with the npm tarball's shasum,
+	// integrity and URL to the .info responses, so the module zip
+	// can be cross-checked against the npm original.
+	InfoOrigin bool
+
+	// InfoBin adds a Bin field with the commands declared in the npm
+	// package's bin field to the .info responses.
+	InfoBin bool
+
+	// InfoEngines adds an Engines field with the runtime constraints
+	// declared in the npm package's engines field, e.g. {"node": ">=14"},
+	// to the .info responses.
+	InfoEngines bool
+
+	// InfoRepository adds a Repository field with the source repository
+	// declared in the npm package version to the .info responses.
+	InfoRepository bool
+
+	// InfoDeprecated adds a Deprecated field with the npm deprecation
+	// message of deprecated versions to the .info responses. They always
+	// get a Warning header with the message.
+	InfoDeprecated bool
+
+	// InfoTypes adds a Types field with the TypeScript declaration file
+	// of packages declaring one in their types or typings field,
+	// e.g. "dist/index.d.ts", to the .info responses. The abbreviated
+	// package documents leave these fields out, see FullMetadata.
+	InfoTypes bool
+
+	// PrefetchOnList starts building the module zip of the latest listed
+	// version in the background on list requests, which the go command
+	// usually follows with a zip request for it, if a zip cache is enabled.
+	// At most 4 zips are prefetched at a time, more are skipped.
+	PrefetchOnList bool
+
+	// ServerTiming adds a Server-Timing header with the time spent
+	// fetching from the registry and building module zips, in milliseconds.
+	ServerTiming bool
+
+	// ShutdownTimeout is how long Shutdown waits for in-flight requests
+	// and module zip builds before cancelling them. Defaults to 5 seconds.
+	ShutdownTimeout time.Duration
+
+	// TarballEndpoint serves the original, verified npm tarball of each
+	// version at $module/@v/$version.tgz, e.g. for auditing. This is not
+	// part of the GOPROXY protocol.
+	TarballEndpoint bool
+
+	// SetupEndpoint serves the go command environment settings needed to
+	// fetch the modules, see Server.GoEnv, as text at /setup.
+	// They are logged on start either way.
+	SetupEndpoint bool
+
+	// DebugAddr, if set, is the TCP address, e.g. localhost:8073, to serve
+	// a JSON view of the cache stats, in-flight builds and recent errors
+	// on at /debug/vars. It's served separately from Addr so it can be
+	// kept off public interfaces.
+	DebugAddr string
+
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and key
+	// files to serve HTTPS with. Plain HTTP is served if not set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSConfig, if set, serves HTTPS with this config, e.g. with
+	// GetCertificate set. The TLS files are added to its certificates.
+	TLSConfig *tls.Config
+
+	// AllowPurge enables DELETE requests to evict cached entries:
+	// $base/$module/@v/$version.zip purges a version and
+	// $base/$module/@v/list purges the whole package.
+	AllowPurge bool
+}
+
+// toolchainRe matches the valid Options.Toolchain values, e.g. go1.21.0 or go1.22rc1.
+var toolchainRe = regexp.MustCompile(`^go1\.(0|[1-9][0-9]*)(\.(0|[1-9][0-9]*))?((rc|beta)[1-9][0-9]*)?$`)
+
+func Start(opts Options) (*Server, error) {
+	if opts.Addr == "" {
+		opts.Addr = "localhost:8072"
+	}
+	if opts.Logger == nil {
+		opts.Logger = internal.DefaultLogger()
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 5 * time.Second
+	}
+	if opts.GoVersion == "" {
+		opts.GoVersion = DefaultGoVersion
+	}
+	if opts.ModulePathBase == "" {
+		opts.ModulePathBase = internal.ModPathBase
+	}
+	opts.ModulePathBase = strings.Trim(opts.ModulePathBase, "/")
+	if err := module.CheckPath(opts.ModulePathBase); err != nil {
+		return nil, fmt.Errorf("invalid module path base %q: %w", opts.ModulePathBase, err)
+	}
+	if !modfile.GoVersionRE.MatchString(opts.GoVersion) {
+		return nil, fmt.Errorf("invalid go version %q, must be of the form 1.21", opts.GoVersion)
+	}
+	if opts.Toolchain != "" && !toolchainRe.MatchString(opts.Toolchain) {
+		return nil, fmt.Errorf("invalid toolchain %q, must be of the form go1.21.0", opts.Toolchain)
+	}
+
+	if opts.Offline && opts.MetadataCacheDir == "" {
+		return nil, errors.New("Offline requires MetadataCacheDir")
+	}
+
+	policy, err := newPackagePolicy(opts.AllowPackages, opts.DenyPackages)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := internal.CheckFilePatterns(append(append([]string(nil), opts.IncludeFiles...), opts.ExcludeFiles...)); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := serverTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := listen(opts.Addr)
 	if err != nil {
 		return nil, err
 	}
 
-	httpServer := &http.Server{Addr: ":8072", Handler: &npmGoModProxy{}}
+	proxy := &npmGoModProxy{
+		opts:    opts,
+		client:  newClient(opts),
+		zips:    newZipCache(opts.CacheDir),
+		memzips: newMemoryCache(opts.MemoryCacheSize),
+		invalid: newInvalidVersions(),
+		builds:  newBuilds(opts.MaxConcurrentZipBuilds),
+		hashes:  newZipHashes(),
+		policy:  policy,
+		applied: opts,
+		errors:  &recentErrors{},
+
+		prefetches: newPrefetches(),
+		infoFields: enabledInfoFields(opts),
+		zipOptions: zipOptions(opts),
+	}
+
+	// The listener's address has the port picked for port 0.
+	httpServer := &http.Server{Addr: l.Addr().String(), Handler: requestIDHandler(compressHandler(proxy)), TLSConfig: tlsConfig}
 	s := &Server{
+		proxy:      proxy,
 		httpServer: httpServer,
+		listener:   l,
+		tls:        tlsConfig != nil,
+	}
+
+	if opts.DebugAddr != "" {
+		dl, err := listen(opts.DebugAddr)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		s.debugListener = dl
+		s.debugServer = &http.Server{Addr: dl.Addr().String(), Handler: s.debugHandler()}
+		go s.debugServer.Serve(dl)
 	}
 
+	proxy.logf(context.Background(), "npmgomodproxy.setup %s", strings.Join(s.GoEnv(), " "))
+
 	go func() {
-		if err := httpServer.Serve(l); err != nil {
+		serve := httpServer.Serve
+		if tlsConfig != nil {
+			serve = func(l net.Listener) error { return httpServer.ServeTLS(l, "", "") }
+		}
+		if err := serve(l); err != nil {
 			if err != http.ErrServerClosed {
 				s.err = err
 			}
@@ -50,21 +508,156 @@ func Start() (*Server, error) {
 	return s, nil
 }
 
+// serverTLSConfig returns the TLS config to serve with, nil for plain HTTP.
+func serverTLSConfig(opts Options) (*tls.Config, error) {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		return opts.TLSConfig, nil
+	}
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return nil, errors.New("both TLSCertFile and TLSKeyFile must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{}
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, cert)
+	return config, nil
+}
+
+// newClient creates the registry client configured by opts.
+func newClient(opts Options) *internal.Client {
+	return internal.NewClient(clientOptions(opts))
+}
+
+// clientOptions returns the registry client options in opts.
+func clientOptions(opts Options) internal.ClientOptions {
+	return internal.ClientOptions{
+		Registry:                     opts.Registry,
+		FallbackRegistries:           opts.FallbackRegistries,
+		RegistryOverrides:            opts.RegistryOverrides,
+		ModulePathBase:               opts.ModulePathBase,
+		URLHosts:                     opts.URLHosts,
+		MetadataTTL:                  opts.MetadataTTL,
+		MetadataTTLJitter:            opts.MetadataTTLJitter,
+		MetadataStaleWhileRevalidate: opts.MetadataStaleWhileRevalidate,
+		MetadataCacheDir:             opts.MetadataCacheDir,
+		Offline:                      opts.Offline,
+		MetadataTimeout:              opts.MetadataTimeout,
+		TarballTimeout:               opts.TarballTimeout,
+		Verification:                 opts.Verification,
+		CaseCollisions:               opts.CaseCollisions,
+		MaxConcurrentRequests:        opts.MaxConcurrentRequests,
+		MaxTarballSize:               opts.MaxTarballSize,
+		MaxPathLength:                opts.MaxPathLength,
+		MaxPathDepth:                 opts.MaxPathDepth,
+		RequireSource:                opts.RequireSource,
+		DocGo:                        opts.DocGo,
+		IncludeFiles:                 opts.IncludeFiles,
+		ExcludeFiles:                 opts.ExcludeFiles,
+		Transform:                    opts.Transform,
+		MaxInMemorySize:              opts.MaxInMemorySize,
+		WorkDir:                      opts.WorkDir,
+		FullMetadata:                 opts.FullMetadata,
+		AuthTokens:                   opts.AuthTokens,
+		UserAgent:                    opts.UserAgent,
+		Contact:                      opts.Contact,
+		Transport:                    opts.Transport,
+		Logger:                       opts.Logger,
+	}
+}
+
 type Server struct {
 	err        error
+	proxy      *npmGoModProxy
 	httpServer *http.Server
+	listener   net.Listener
+
+	// tls is set when serving HTTPS. The http.Server's TLSConfig
+	// can't tell, as serving plain HTTP sets one up for HTTP/2.
+	tls bool
+
+	debugServer   *http.Server
+	debugListener net.Listener
 }
 
+// Stats holds cache statistics for a Server.
+type Stats struct {
+	// MemoryCacheHits and MemoryCacheMisses count lookups in the in-memory zip cache.
+	MemoryCacheHits   uint64
+	MemoryCacheMisses uint64
+}
+
+// Stats returns the current cache statistics.
+func (s *Server) Stats() Stats {
+	var stats Stats
+	stats.MemoryCacheHits, stats.MemoryCacheMisses = s.proxy.memzips.stats()
+	return stats
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// TCPAddr returns the address the server is listening on, with the
+// port picked if Options.Addr has port 0 and an unspecified IP, e.g.
+// 0.0.0.0 or ::, if it has no host.
+func (s *Server) TCPAddr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+// listen listens on the TCP address addr, which must have a port,
+// e.g. localhost:8072, [::1]:8072 or :8072.
+func listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// DebugAddr returns the address the debug endpoint is listening on,
+// nil if Options.DebugAddr isn't set.
+func (s *Server) DebugAddr() net.Addr {
+	if s.debugListener == nil {
+		return nil
+	}
+	return s.debugListener.Addr()
+}
+
+// Shutdown stops the server, waiting up to Options.ShutdownTimeout for
+// in-flight requests and module zip builds, e.g. from Prewarm, to finish.
+// Builds still running after that are cancelled and their temp dirs
+// removed before Shutdown returns.
 func (s *Server) Shutdown() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), s.proxy.opts.ShutdownTimeout)
 	defer cancel()
-	if err := s.httpServer.Shutdown(ctx); err != nil {
+	if s.debugServer != nil {
+		s.debugServer.Close()
+	}
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		// Unblock handlers still writing to slow clients.
+		s.httpServer.Close()
+	}
+	if !s.proxy.builds.wait(ctx) {
+		s.proxy.logf(ctx, "warning: cancelled module zip builds still running after %s", s.proxy.opts.ShutdownTimeout)
+	}
+	if err != nil {
 		return err
 	}
 	return s.err
 }
 
 type moduleContext struct {
+	ModulePathBase   string
 	NpmPackage       string
 	Version          string
 	PathMajorVersion string
@@ -74,38 +667,200 @@ func (ctx moduleContext) String() string {
 	return fmt.Sprintf("%s|%s|%s", ctx.NpmPackage, ctx.Version, ctx.PathMajorVersion)
 }
 
-type npmGoModProxy struct{}
+func (ctx moduleContext) modulePath() string {
+	return internal.ModulePath(ctx.ModulePathBase, ctx.NpmPackage, ctx.PathMajorVersion)
+}
+
+// escapedModulePath returns the module path escaped for use in
+// GOPROXY URLs and file names, e.g. with uppercase letters as !lowercase.
+func (ctx moduleContext) escapedModulePath() string {
+	p, err := module.EscapePath(ctx.modulePath())
+	if err != nil {
+		// Not a valid module path, which the router rejects.
+		return ctx.modulePath()
+	}
+	return p
+}
+
+type npmGoModProxy struct {
+	opts    Options
+	zips    *zipCache
+	memzips *memoryCache
+	invalid *invalidVersions
+	builds  *builds
+	hashes  *zipHashes
+	errors  *recentErrors
+
+	prefetches *prefetches
+
+	// infoFields are the optional .info fields enabled in opts.
+	infoFields []infoField
+
+	// zipOptions are the options in opts changing the module zips, see zipKey.
+	zipOptions string
+
+	// mu guards client, policy and applied, which are replaced by
+	// Server.Reload. applied is opts with the Config last applied.
+	mu      sync.RWMutex
+	client  *internal.Client
+	policy  *packagePolicy
+	applied Options
+}
+
+type nameReadSeekCloser interface {
+	io.ReadSeekCloser
+	Name() string
+}
+
+// fetchVersion fetches the npm package version requested in mctx. A version
+// of another major version than the module's, e.g. v3.0.0 below .../v2,
+// isn't in the module, so that's an ErrVersionNotFound.
+// mctx.Version is set to the version resolved, e.g. for a dist-tag such as
+// latest, which may move, so the caches are keyed by the version.
+func (g *npmGoModProxy) fetchVersion(ctx context.Context, mctx *moduleContext) (internal.Version, error) {
+	npmv, err := g.currentClient().FetchPackageVersion(ctx, mctx.NpmPackage, mctx.Version)
+	if err != nil {
+		return npmv, err
+	}
+	if internal.PathMajor(npmv.Version) != mctx.PathMajorVersion {
+		return internal.Version{}, fmt.Errorf("version %q of package %q is not in module %s: %w", npmv.Version, mctx.NpmPackage, mctx.modulePath(), internal.ErrVersionNotFound)
+	}
+	mctx.Version = npmv.Version
+	return npmv, nil
+}
 
 // $base/$module/@v/$version.info
 // Returns JSON-formatted metadata about a specific version of a module.
 func (g *npmGoModProxy) Info(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
-	fmt.Println("npmgomodproxy.info", mctx)
+	g.logf(r.Context(), "npmgomodproxy.info %s", mctx)
 
-	npmv, err := internal.FetchPackageVersion(mctx.NpmPackage, mctx.Version)
+	start := time.Now()
+	npmv, err := g.fetchVersion(r.Context(), &mctx)
+	g.addTiming(w, "fetch", start)
 	if err != nil {
-		g.fail(w, "failed to fetch package version", err)
+		g.fail(w, r, "failed to fetch package version", err)
 		return
 	}
 
-	g.encodeVersion(w, npmv)
+	if npmv.Deprecated != "" {
+		w.Header().Set("Warning", warning(fmt.Sprintf("%s@%s is deprecated: %s", npmv.Name, strings.TrimPrefix(npmv.Version, "v"), npmv.Deprecated)))
+	}
 
+	published, err := g.currentClient().PublishTime(r.Context(), mctx.NpmPackage, npmv.Version)
+	if err != nil {
+		g.logf(r.Context(), "warning: %s@%s: failed to get publish time: %s", mctx.NpmPackage, mctx.Version, err)
+	}
+
+	g.encodeVersion(w, npmv, published)
 }
 
 func (g *npmGoModProxy) List(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
-	fmt.Println("npmgomodproxy.list", mctx)
+	g.logf(r.Context(), "npmgomodproxy.list %s", mctx)
 
-	npmpkg, err := internal.FetchPackage(mctx.NpmPackage)
+	start := time.Now()
+	infos, err := g.currentClient().Versions(r.Context(), mctx.NpmPackage)
+	g.addTiming(w, "fetch", start)
 	if err != nil {
-		g.fail(w, "failed to fetch package", err)
+		g.fail(w, r, "failed to fetch package", err)
 		return
 	}
 
 	var versions []string
-	for _, v := range npmpkg.Versions {
+	for _, v := range infos {
+		// Each major version is a module of its own, see moduleContext.
+		if internal.PathMajor(v.Version) != mctx.PathMajorVersion {
+			continue
+		}
+		if g.opts.ValidatedList && g.invalid.contains(mctx.NpmPackage, v.Version) {
+			continue
+		}
+		if g.opts.MaxListVersions > 0 && v.Prerelease {
+			continue
+		}
 		versions = append(versions, v.Version)
 	}
+	if max := g.opts.MaxListVersions; max > 0 && len(versions) > max {
+		// The versions are sorted, keep the highest.
+		versions = versions[len(versions)-max:]
+	}
+	// A package without any versions left to list, e.g. with only
+	// pre-releases, exists, so that's an empty list and not a 404.
+	list := strings.Join(versions, "\n")
+
+	if g.opts.PrefetchOnList && r.Method == http.MethodGet {
+		g.prefetchLatest(mctx, versions)
+	}
+
+	// New versions are rare, so let clients revalidate cheaply.
+	if notModified(w, r, weakETag(list), time.Time{}) {
+		return
+	}
 
-	fmt.Fprint(w, strings.Join(versions, "\n"))
+	fmt.Fprint(w, list)
+}
+
+// weakETag returns a weak ETag for the response body s.
+func weakETag(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return fmt.Sprintf(`W/"%x"`, sum[:16])
+}
+
+// notModified sets the ETag and, if modTime is not zero, the Last-Modified
+// header, and responds with a 304 if the conditional headers in r match them.
+// It reports whether it did so, in which case the caller should not write a body.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		match = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		// If-None-Match takes precedence, as per RFC 7232.
+		t, err := http.ParseTime(ims)
+		match = err == nil && !modTime.Truncate(time.Second).After(t)
+	}
+	if match {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return match
+}
+
+// etagMatches reports whether the If-None-Match header value
+// ifNoneMatch matches etag using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// $base/$module/@v/tags
+// Returns the npm dist-tags of the package as a JSON object mapping
+// tag names to versions. This is not part of the GOPROXY protocol.
+func (g *npmGoModProxy) Tags(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
+	g.logf(r.Context(), "npmgomodproxy.tags %s", mctx)
+
+	start := time.Now()
+	npmpkg, err := g.currentClient().FetchPackage(r.Context(), mctx.NpmPackage)
+	g.addTiming(w, "fetch", start)
+	if err != nil {
+		g.fail(w, r, "failed to fetch package", err)
+		return
+	}
+
+	tags := npmpkg.DistTags.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
 }
 
 // $base/$module/@v/$version.mod
@@ -114,49 +869,150 @@ func (g *npmGoModProxy) List(w http.ResponseWriter, r *http.Request, mctx module
 // module statement with the requested module path must be returned. Otherwise,
 // the original, unmodified go.mod file must be returned.
 func (g *npmGoModProxy) Mod(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
-	fmt.Println("npmgomodproxy.mod", mctx)
+	g.logf(r.Context(), "npmgomodproxy.mod %s", mctx)
 
-	npmv, err := internal.FetchPackageVersion(mctx.NpmPackage, mctx.Version)
+	start := time.Now()
+	npmv, err := g.fetchVersion(r.Context(), &mctx)
+	g.addTiming(w, "fetch", start)
 	if err != nil {
-		g.fail(w, "failed to fetch package version", err)
+		g.fail(w, r, "failed to fetch package version", err)
 		return
 	}
 
-	depLine := func(dep internal.Dependency) string {
-		return fmt.Sprintf("\tgohugo.io/npmjs/%s/v3 %s\n", internal.EscapePackage(dep.Name), "v3.1.1") // TODO1 version range + mahor path?
+	f := &modfile.File{}
+	if err := f.AddModuleStmt(mctx.modulePath()); err != nil {
+		g.fail(w, r, "failed to create go.mod", err)
+		return
+	}
+	if err := f.AddGoStmt(g.opts.GoVersion); err != nil {
+		g.fail(w, r, "failed to create go.mod", err)
+		return
+	}
+	if g.opts.Toolchain != "" {
+		// This version of modfile doesn't know about toolchain directives.
+		f.Syntax.Stmt = append(f.Syntax.Stmt, &modfile.Line{Token: []string{"toolchain", g.opts.Toolchain}})
 	}
 
-	var requires string
-	if len(npmv.Dependencies) > 0 {
-		requires = "require (\n"
-		for _, dep := range npmv.Dependencies {
-			requires += depLine(dep)
+	var pinned internal.Shrinkwrap
+	if g.opts.Shrinkwrap && !g.opts.WithoutDependencies {
+		start := time.Now()
+		pinned, err = g.currentClient().FetchShrinkwrap(r.Context(), npmv)
+		g.addTiming(w, "shrinkwrap", start)
+		if err != nil {
+			g.fail(w, r, "failed to read shrinkwrap", err)
+			return
 		}
-		requires += ")\n"
 	}
 
-	gomod := `
+	for _, dep := range g.dependencies(npmv) {
+		switch internal.ClassifyRange(dep.VersionRange) {
+		case internal.RangeLocal:
+			g.logf(r.Context(), "warning: %s: skipping local dependency %s@%s", mctx.NpmPackage, dep.Name, dep.VersionRange)
+			continue
+		case internal.RangeURL:
+			g.fail(w, r, "failed to resolve dependencies", fmt.Errorf("%s@%s: git and URL dependencies are not supported", dep.Name, dep.VersionRange))
+			return
+		}
+
+		var depv internal.Version
+		if v, found := pinned[dep.Name]; found && !g.overridden(dep.Name) {
+			depv, err = g.currentClient().FetchPackageVersion(r.Context(), dep.Name, v)
+		} else {
+			depv, err = g.currentClient().ResolveDependency(r.Context(), dep)
+		}
+		if err != nil {
+			g.fail(w, r, "failed to resolve dependencies", err)
+			return
+		}
 
-module gohugo.io/npmjs/%s
+		// The packages don't import their dependencies as Go packages,
+		// so mark them indirect to keep go mod tidy quiet.
+		f.AddNewRequire(internal.VersionModulePath(g.opts.ModulePathBase, dep.Name, depv.Version), depv.Version, true)
+	}
 
-%s
+	b, err := f.Format()
+	if err != nil {
+		g.fail(w, r, "failed to format go.mod", err)
+		return
+	}
 
-go 1.17
-	
-	
-`
+	// The go.mod of a version never changes, so let clients revalidate cheaply.
+	published, err := g.currentClient().PublishTime(r.Context(), mctx.NpmPackage, npmv.Version)
+	if err != nil {
+		g.logf(r.Context(), "warning: %s@%s: failed to get publish time: %s", mctx.NpmPackage, mctx.Version, err)
+	}
+	if notModified(w, r, weakETag(string(b)), published) {
+		return
+	}
 
-	fmt.Fprintf(w, gomod, path.Join(internal.EscapePackage(mctx.NpmPackage), mctx.PathMajorVersion), requires)
+	w.Write(b)
+}
+
+// overridden reports whether the range of the dependency name is replaced
+// by Options.DependencyOverrides.
+func (g *npmGoModProxy) overridden(name string) bool {
+	_, found := g.opts.DependencyOverrides[name]
+	return found
+}
+
+// dependencies returns the dependencies of v to require in go.mod.
+// Optional dependencies are treated as regular dependencies, as npm installs
+// them when available. Peer dependencies are included if configured.
+// If a dependency is listed in more than one group, the first one wins.
+func (g *npmGoModProxy) dependencies(v internal.Version) internal.Dependencies {
+	if g.opts.WithoutDependencies {
+		return nil
+	}
+
+	groups := []internal.Dependencies{v.Dependencies, v.OptionalDependencies}
+	if g.opts.PeerDependencies {
+		groups = append(groups, v.PeerDependencies)
+	}
+
+	var deps internal.Dependencies
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, dep := range group {
+			if seen[dep.Name] {
+				continue
+			}
+			seen[dep.Name] = true
+			if override, found := g.opts.DependencyOverrides[dep.Name]; found {
+				if override == "" {
+					continue
+				}
+				dep.VersionRange = override
+			}
+			deps = append(deps, dep)
+		}
+	}
+
+	sort.Slice(deps, func(i, j int) bool {
+		return deps[i].Name < deps[j].Name
+	})
+
+	return deps
 }
 
 func (g *npmGoModProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodDelete:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+	case r.Method == http.MethodDelete && g.opts.AllowPurge:
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Allow", g.allowedMethods())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		methodNotAllowed(w, g.allowedMethods())
+		return
+	}
+
+	if g.opts.SetupEndpoint && r.URL.Path == "/setup" && r.Method != http.MethodDelete {
+		g.Setup(w, r)
 		return
 	}
 
-	if !strings.HasPrefix(r.URL.Path, "/"+npmjsPrefix) {
+	if !strings.HasPrefix(r.URL.Path, "/"+g.opts.ModulePathBase+"/") {
 		http.NotFound(w, r)
 		return
 	}
@@ -165,39 +1021,66 @@ func (g *npmGoModProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		id      string
 		regexp  *regexp.Regexp
 		handler func(w http.ResponseWriter, r *http.Request, mctx moduleContext)
+		purge   func(w http.ResponseWriter, r *http.Request, mctx moduleContext)
 	}{
-		{"list", apiList, g.List},
-		{"info", apiInfo, g.Info},
-		{"npmgomodproxy", apiMod, g.Mod},
-		{"zip", apiZip, g.Zip},
+		{"list", apiList, g.List, g.PurgePackage},
+		{"tags", apiTags, g.Tags, nil},
+		{"info", apiInfo, g.Info, nil},
+		{"npmgomodproxy", apiMod, g.Mod, nil},
+		{"zip", apiZip, g.Zip, g.PurgeVersion},
+		{"ziphash", apiZipHash, g.ZipHash, nil},
+		{"tgz", apiTarball, g.Tarball, nil},
 	} {
 		if m := route.regexp.FindStringSubmatch(r.URL.Path); m != nil {
 			pathVersion, version := m[1], ""
 			if len(m) > 2 {
 				version = m[2]
+				if err := checkVersion(version); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
 
-			pathVersion, err := module.EscapePath(pathVersion)
+			// The go command escapes uppercase letters in module paths, e.g. !j!s!o!n!stream.
+			modulePath, err := module.UnescapePath(pathVersion)
 			if err != nil {
-				g.fail(w, "failed to escape path", err)
+				http.NotFound(w, r)
 				return
 			}
 
-			if pathVersion == internal.ModPathBase {
+			npmPackage, major, err := internal.ParseModulePath(g.opts.ModulePathBase, modulePath, g.opts.ModulePathEscaping)
+			if err != nil {
 				http.NotFound(w, r)
 				return
 			}
-
-			npmPackage, major, _ := module.SplitPathVersion(pathVersion)
-			npmPackage = strings.TrimPrefix(npmPackage, npmjsPrefix)
+			if err := internal.CheckPackageName(npmPackage); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
 			mctx := moduleContext{
-				NpmPackage:       internal.UnEscapePackage(npmPackage),
+				ModulePathBase:   g.opts.ModulePathBase,
+				NpmPackage:       npmPackage,
 				PathMajorVersion: major,
 				Version:          version,
 			}
 
-			route.handler(w, r, mctx)
+			if err := g.currentPolicy().check(npmPackage); err != nil {
+				g.logf(r.Context(), "npmgomodproxy.forbidden %s", mctx)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			handler := route.handler
+			if r.Method == http.MethodDelete {
+				handler = route.purge
+			}
+			if handler == nil {
+				methodNotAllowed(w, "GET, HEAD")
+				return
+			}
+
+			handler(w, r, mctx)
 			return
 		}
 	}
@@ -205,47 +1088,372 @@ func (g *npmGoModProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+// allowedMethods returns the methods the proxy supports, for the Allow header.
+func (g *npmGoModProxy) allowedMethods() string {
+	if g.opts.AllowPurge {
+		return "GET, HEAD, DELETE"
+	}
+	return "GET, HEAD"
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// checkVersion checks that the version v from a request path is
+// either a valid semantic version or looks like a npm dist-tag.
+func checkVersion(v string) error {
+	if v == "" {
+		return errors.New("missing version")
+	}
+	if strings.ContainsAny(v, `/\`) || strings.Contains(v, "..") {
+		return fmt.Errorf("invalid version %q", v)
+	}
+	if !semver.IsValid(v) && !internal.IsDistTag(v) {
+		return fmt.Errorf("invalid version %q", v)
+	}
+	return nil
+}
+
 // Returns a zip file containing the contents of a specific version of a module.
 func (g *npmGoModProxy) Zip(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
-	fmt.Println("npmgomodproxy.zip", mctx)
+	g.logf(r.Context(), "npmgomodproxy.zip %s", mctx)
 
-	npmv, err := internal.FetchPackageVersion(mctx.NpmPackage, mctx.Version)
+	requested := mctx.Version
+	start := time.Now()
+	npmv, err := g.fetchVersion(r.Context(), &mctx)
+	g.addTiming(w, "fetch", start)
 	if err != nil {
-		g.fail(w, "failed to fetch package version", err)
+		g.fail(w, r, "failed to fetch package version", err)
+		return
+	}
+
+	// The zip of a version never changes, unlike the version a dist-tag
+	// such as latest points to.
+	if mctx.Version == requested {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	// The zip is likely being prefetched after a list request.
+	g.prefetches.wait(r.Context(), prefetchKey(mctx, npmv.Version))
+
+	if e, found := g.memzips.get(g.zipKey(mctx, npmv.Dist.ShaSum)); found {
+		http.ServeContent(w, r, mctx.Version+".zip", e.modTime, bytes.NewReader(e.b))
+		return
+	}
+
+	if f, cleanup, found := g.getStoredZip(r.Context(), mctx, npmv.Dist.ShaSum); found {
+		defer cleanup()
+		g.serveZip(w, r, mctx, npmv, f)
 		return
 	}
 
-	f, err := internal.CreateZipFromVersion(npmv)
+	if f, found := g.zips.get(mctx); found {
+		defer f.Close()
+		g.serveZip(w, r, mctx, npmv, f)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		g.headUncachedZip(w, r, mctx, "application/zip")
+		return
+	}
+
+	start = time.Now()
+	f, cleanup, err := g.buildZip(r.Context(), mctx, npmv)
+	g.addTiming(w, "build", start)
 	if err != nil {
-		g.fail(w, "failed to create module zip", err)
+		g.fail(w, r, "failed to create module zip", err)
 		return
 	}
-	defer func() {
+	defer cleanup()
+
+	g.serveZip(w, r, mctx, npmv, f)
+}
+
+// Tarball serves the npm tarball of a version as published, see Options.TarballEndpoint.
+func (g *npmGoModProxy) Tarball(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
+	if !g.opts.TarballEndpoint {
+		http.NotFound(w, r)
+		return
+	}
+
+	g.logf(r.Context(), "npmgomodproxy.tgz %s", mctx)
+
+	start := time.Now()
+	npmv, err := g.fetchVersion(r.Context(), &mctx)
+	g.addTiming(w, "fetch", start)
+	if err != nil {
+		g.fail(w, r, "failed to fetch package version", err)
+		return
+	}
+
+	published, err := g.currentClient().PublishTime(r.Context(), mctx.NpmPackage, npmv.Version)
+	if err != nil {
+		g.logf(r.Context(), "warning: %s@%s: failed to get publish time: %s", mctx.NpmPackage, mctx.Version, err)
+	}
+
+	// The tarball of a version never changes.
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	etag := weakETag(npmv.Dist.ShaSum + npmv.Dist.Integrity)
+	if notModified(w, r, etag, published) {
+		return
+	}
+	if r.Method == http.MethodHead {
+		headUncached(w, "application/gzip")
+		return
+	}
+
+	start = time.Now()
+	f, err := g.currentClient().DownloadTarball(r.Context(), npmv)
+	g.addTiming(w, "download", start)
+	if err != nil {
+		g.fail(w, r, "failed to download tarball", err)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, f.Name(), published, f)
+}
+
+// buildZip builds the module zip for v and adds it to the blob store
+// and the disk cache, if enabled.
+// The returned cleanup func must be called when done with the zip.
+func (g *npmGoModProxy) buildZip(ctx context.Context, mctx moduleContext, v internal.Version) (nameReadSeekCloser, func(), error) {
+	ctx, done := g.builds.start(ctx)
+	release, err := g.builds.acquire(ctx)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	f, err := g.currentClient().CreateZipFromVersion(ctx, v)
+	release()
+	if err != nil {
+		done()
+		if errors.Is(err, internal.ErrInvalidModule) {
+			g.invalid.add(v.Name, v.Version)
+		}
+		return nil, nil, err
+	}
+	cleanup := func() {
 		f.Close()
-		os.RemoveAll(filepath.Dir(f.Name()))
-	}()
+		done()
+	}
+
+	g.storeZip(ctx, mctx, v.Dist.ShaSum, f)
+
+	if g.zips != nil {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			err = g.zips.put(mctx, f)
+		}
+		if err != nil {
+			g.logf(ctx, "error: failed to cache module zip: %s", err)
+		}
+	}
+
+	return f, cleanup, nil
+}
+
+// PurgeVersion removes a version from the metadata and zip caches.
+func (g *npmGoModProxy) PurgeVersion(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
+	g.logf(r.Context(), "npmgomodproxy.purge %s", mctx)
+
+	stored := g.deleteStoredZips(r.Context(), g.purgedZipKeys(r.Context(), mctx, false))
+	forgotten := g.currentClient().Forget(mctx.NpmPackage)
+	removed := g.zips.remove(mctx)
+	revalidate := g.invalid.remove(mctx.NpmPackage, mctx.Version)
+	g.purged(w, forgotten || removed || revalidate || stored)
+}
+
+// PurgePackage removes a package and all of its versions from the metadata and zip caches.
+func (g *npmGoModProxy) PurgePackage(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
+	g.logf(r.Context(), "npmgomodproxy.purgepackage %s", mctx)
+
+	stored := g.deleteStoredZips(r.Context(), g.purgedZipKeys(r.Context(), mctx, true))
+	forgotten := g.currentClient().Forget(mctx.NpmPackage)
+	removed := g.zips.removeModule(mctx)
+	revalidate := g.invalid.remove(mctx.NpmPackage, "")
+	g.purged(w, forgotten || removed || revalidate || stored)
+}
 
-	// TODO1 cache + cache headers
-	http.ServeContent(w, r, f.Name(), time.Now(), f)
+// purgedZipKeys returns the keys of the zips in Options.BlobStore
+// for the version in mctx, or all versions of its package.
+// They're looked up before the package is forgotten, so usually without
+// a registry request.
+func (g *npmGoModProxy) purgedZipKeys(ctx context.Context, mctx moduleContext, allVersions bool) []string {
+	if g.opts.BlobStore == nil {
+		return nil
+	}
+	var keys []string
+	if allVersions {
+		npmpkg, err := g.currentClient().FetchPackage(ctx, mctx.NpmPackage)
+		if err != nil {
+			g.logf(ctx, "warning: failed to look up the zips of %s to purge from the blob store: %s", mctx.NpmPackage, err)
+			return nil
+		}
+		for _, v := range npmpkg.Versions {
+			vctx := mctx
+			vctx.Version = v.Version
+			vctx.PathMajorVersion = internal.PathMajor(v.Version)
+			keys = append(keys, g.zipKey(vctx, v.Dist.ShaSum))
+		}
+		return keys
+	}
+	npmv, err := g.currentClient().FetchPackageVersion(ctx, mctx.NpmPackage, mctx.Version)
+	if err != nil {
+		g.logf(ctx, "warning: failed to look up the zip of %s to purge from the blob store: %s", mctx, err)
+		return nil
+	}
+	return []string{g.zipKey(mctx, npmv.Dist.ShaSum)}
 }
 
-func (g *npmGoModProxy) encodeVersion(w io.Writer, version internal.Version) {
-	info := versionInfo{
-		Version: version.Version,
-		// TODO1 time
+func (g *npmGoModProxy) purged(w http.ResponseWriter, found bool) {
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveZip serves the zip in f, adding it to the memory cache if enabled.
+// HEAD requests only get the headers and leave the memory cache alone.
+// Zips are built in full before they're served, never streamed, so the
+// response always has a Content-Length, e.g. for download progress.
+func (g *npmGoModProxy) serveZip(w http.ResponseWriter, r *http.Request, mctx moduleContext, v internal.Version, f nameReadSeekCloser) {
+	var modTime time.Time
+	if r.Method == http.MethodHead {
+		modTime = zipModTime(f)
+	} else {
+		modTime = g.memorizeZip(mctx, v, f)
 	}
-	jsonEnc := json.NewEncoder(w)
-	jsonEnc.Encode(info)
+	http.ServeContent(w, r, f.Name(), modTime, f)
 }
 
-func (g *npmGoModProxy) fail(w http.ResponseWriter, what string, err error) {
-	err = fmt.Errorf("%s: %s", what, err)
-	fmt.Println("error:", err)
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprint(w, err.Error())
+// headUncached answers a HEAD request for a zip that isn't cached.
+// Building the zip just to tell its size isn't worth it, so there's no
+// Content-Length; a GET afterwards builds and caches it as usual.
+func headUncached(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
 }
 
-type versionInfo struct {
-	Version string    // version string
-	Time    time.Time // commit time
+// headUncachedZip is headUncached for the module zip, or its hash, of the
+// version in mctx, known to exist. Versions that failed to repack as valid
+// Go modules before get the error a GET would.
+func (g *npmGoModProxy) headUncachedZip(w http.ResponseWriter, r *http.Request, mctx moduleContext, contentType string) {
+	if g.invalid.contains(mctx.NpmPackage, mctx.Version) {
+		g.fail(w, r, "failed to create module zip", fmt.Errorf("%s@%s: %w", mctx.NpmPackage, mctx.Version, internal.ErrInvalidModule))
+		return
+	}
+	headUncached(w, contentType)
+}
+
+// zipModTime returns the modification time of the zip in f,
+// or now if it's not a file.
+func zipModTime(f nameReadSeekCloser) time.Time {
+	if fi, ok := f.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := fi.Stat(); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return time.Now()
+}
+
+// memorizeZip adds the zip in f to the memory cache, if enabled,
+// and returns its modification time.
+func (g *npmGoModProxy) memorizeZip(mctx moduleContext, v internal.Version, f nameReadSeekCloser) time.Time {
+	modTime := zipModTime(f)
+
+	if g.memzips != nil {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			if b, err := io.ReadAll(f); err == nil {
+				g.memzips.put(g.zipKey(mctx, v.Dist.ShaSum), b, modTime)
+			}
+		}
+	}
+
+	return modTime
+}
+
+// warning returns a Warning header value with the miscellaneous
+// persistent warning code 299 and the text msg, see RFC 7234.
+func warning(msg string) string {
+	msg = strings.Join(strings.Fields(msg), " ")
+	return "299 - " + strconv.Quote(msg)
+}
+
+// addTiming adds the time since start as the metric name
+// to the Server-Timing header, if enabled.
+func (g *npmGoModProxy) addTiming(w http.ResponseWriter, name string, start time.Time) {
+	if !g.opts.ServerTiming {
+		return
+	}
+	w.Header().Add("Server-Timing", fmt.Sprintf("%s;dur=%.1f", name, float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+// logf logs using the configured logger, prefixed with the request ID in ctx, if any.
+func (g *npmGoModProxy) logf(ctx context.Context, format string, args ...interface{}) {
+	internal.Logf(ctx, g.opts.Logger, format, args...)
+}
+
+// fail logs err and writes a one line plain text error response.
+// Known errors get a concise message and a matching status, e.g. 404 for
+// missing packages, which the go command treats as "not found".
+// Other errors are described by what and the sanitized err.
+func (g *npmGoModProxy) fail(w http.ResponseWriter, r *http.Request, what string, err error) {
+	g.logf(r.Context(), "error: %s: %s", what, err)
+
+	status, msg := http.StatusInternalServerError, ""
+	for _, known := range []struct {
+		err    error
+		status int
+	}{
+		// Tell the go command that the version is permanently unavailable.
+		{internal.ErrVersionUnpublished, http.StatusGone},
+		{internal.ErrUppercasePackageName, http.StatusNotFound},
+		{internal.ErrPackageNotFound, http.StatusNotFound},
+		{internal.ErrVersionNotFound, http.StatusNotFound},
+		{internal.ErrOffline, http.StatusNotFound},
+		{internal.ErrRegistryUnavailable, http.StatusBadGateway},
+		// The proxy's credentials are the problem, not the client's.
+		{internal.ErrRegistryUnauthorized, http.StatusBadGateway},
+		// The registry served a corrupt tarball.
+		{internal.ErrShasumMismatch, http.StatusBadGateway},
+		{internal.ErrIntegrityMismatch, http.StatusBadGateway},
+	} {
+		if errors.Is(err, known.err) {
+			status, msg = known.status, known.err.Error()
+			break
+		}
+	}
+	detailed := what + ": " + g.sanitizeError(err)
+	if msg == "" {
+		msg = detailed
+	}
+	g.errors.add(r.Context(), status, detailed)
+
+	// The Cache-Control may be set for the response this replaces, e.g. a zip.
+	w.Header().Del("Cache-Control")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, msg)
+}
+
+var urlUserinfoRe = regexp.MustCompile(`(://)[^/@\s]+@`)
+
+// sanitizeError returns err as one line without credentials in URLs
+// and with paths in the work, temp and cache directories reduced to
+// their base names, as the go command shows it to users.
+func (g *npmGoModProxy) sanitizeError(err error) string {
+	s := urlUserinfoRe.ReplaceAllString(err.Error(), "$1")
+	for _, dir := range []string{g.opts.CacheDir, g.opts.WorkDir, os.TempDir()} {
+		if dir == "" {
+			continue
+		}
+		re := regexp.MustCompile(regexp.QuoteMeta(filepath.Clean(dir)) + `[^\s:]*`)
+		s = re.ReplaceAllStringFunc(s, filepath.Base)
+	}
+	return strings.Join(strings.Fields(s), " ")
 }
@@ -0,0 +1,49 @@
+package npmgop
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GoEnv returns the go command environment settings, e.g. for go env -w,
+// needed to fetch the modules below Options.ModulePathBase from the server.
+// The modules are synthesized by the proxy and not in the public checksum
+// database, so GONOSUMDB skips them. GOPRIVATE isn't used, as it also
+// makes the go command bypass the proxy for them.
+func (s *Server) GoEnv() []string {
+	scheme := "http"
+	if s.tls {
+		scheme = "https"
+	}
+	host := s.Addr().String()
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if ip := net.ParseIP(h); ip != nil && ip.IsUnspecified() {
+			host = net.JoinHostPort("localhost", port)
+		}
+	}
+	return goEnv(scheme+"://"+host, s.proxy.opts.ModulePathBase)
+}
+
+// goEnv returns the go command environment settings for the modules
+// below modulePathBase served by the proxy at proxyURL.
+// The go command falls back to the next proxy on a 404 for other modules.
+func goEnv(proxyURL, modulePathBase string) []string {
+	return []string{
+		"GOPROXY=" + proxyURL + ",https://proxy.golang.org,direct",
+		"GONOSUMDB=" + modulePathBase,
+	}
+}
+
+// Setup serves the go command environment settings, see Server.GoEnv,
+// as seen by the client, e.g. with the host the proxy is reached on.
+func (g *npmGoModProxy) Setup(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# Settings to fetch the npm packages below %s, e.g. with go env -w:\n", g.opts.ModulePathBase)
+	fmt.Fprintln(w, strings.Join(goEnv(scheme+"://"+r.Host, g.opts.ModulePathBase), "\n"))
+}
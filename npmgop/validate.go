@@ -0,0 +1,86 @@
+package npmgop
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bep/npmgoproxy/internal"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
+)
+
+// ValidateResult describes a npm package version repacked as a Go module.
+type ValidateResult struct {
+	// ModulePath is the Go module path, e.g. gohugo.io/npmjs/foo/v2.
+	ModulePath string
+
+	// Version is the Go module version, e.g. v2.1.0.
+	Version string
+
+	// Files is the number of files in the module zip.
+	Files int
+}
+
+// Validate fetches the npm package version spec, e.g. foo@1.2.3, @scope/foo@latest or foo,
+// repacks it as a Go module zip and checks the result, without starting a server.
+// The spec can also be a tarball or GitHub git URL, e.g. github:user/repo#v1.0.0,
+// from one of the hosts in Options.URLHosts.
+// Only the registry related fields in opts are used.
+func Validate(ctx context.Context, opts Options, spec string) (ValidateResult, error) {
+	var result ValidateResult
+
+	pkg, version := spec, "latest"
+	if i := strings.LastIndex(spec, "@"); i > 0 {
+		pkg, version = spec[:i], spec[i+1:]
+	}
+
+	// The zip is checked on disk.
+	opts.MaxInMemorySize = 0
+	client := newClient(opts)
+
+	var npmv internal.Version
+	var f nameReadSeekCloser
+	var err error
+	if internal.IsURLPackage(spec) {
+		// Repacked right away, so the tarball is downloaded once.
+		npmv, f, err = client.CreateZipFromURLPackage(ctx, spec)
+	} else if internal.IsDistTag(version) {
+		var npmpkg internal.NpmPackage
+		npmpkg, err = client.FetchPackage(ctx, pkg)
+		if err == nil {
+			npmv, err = npmpkg.ResolveRange(version)
+		}
+	} else {
+		npmv, err = client.FetchPackageVersion(ctx, pkg, "v"+strings.TrimPrefix(version, "v"))
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to fetch %s: %w", spec, err)
+	}
+
+	base := opts.ModulePathBase
+	if base == "" {
+		base = internal.ModPathBase
+	}
+	result.ModulePath = internal.VersionModulePath(base, npmv.Name, npmv.Version)
+	result.Version = npmv.Version
+
+	if f == nil {
+		f, err = client.CreateZipFromVersion(ctx, npmv)
+		if err != nil {
+			return result, fmt.Errorf("failed to create module zip: %w", err)
+		}
+	}
+	defer f.Close()
+
+	cf, err := zip.CheckZip(module.Version{Path: result.ModulePath, Version: result.Version}, f.Name())
+	if err != nil {
+		return result, fmt.Errorf("invalid module zip: %w", err)
+	}
+	if err := cf.Err(); err != nil {
+		return result, fmt.Errorf("invalid module zip: %w", err)
+	}
+	result.Files = len(cf.Valid)
+
+	return result, nil
+}
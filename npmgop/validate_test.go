@@ -0,0 +1,121 @@
+package npmgop
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bep/npmgoproxy/internal/npmtest"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("@scope/foo", "2.1.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+	registry.AddVersion("bad", "1.0.0", map[string]string{"package.json": `{}`, "con.js": "x"}, nil)
+
+	opts := Options{Registry: registry.URL}
+
+	for _, spec := range []string{"@scope/foo@2.1.0", "@scope/foo@v2.1.0", "@scope/foo@latest", "@scope/foo"} {
+		result, err := Validate(context.Background(), opts, spec)
+		c.Assert(err, qt.IsNil, qt.Commentf(spec))
+		c.Assert(result, qt.Equals, ValidateResult{ModulePath: "gohugo.io/npmjs/___scope/foo/v2", Version: "v2.1.0", Files: 2})
+	}
+
+	_, err := Validate(context.Background(), opts, "bad@1.0.0")
+	c.Assert(err, qt.ErrorMatches, `failed to create module zip: package contains files not allowed in a Go module: .*con.js.*`)
+
+	_, err = Validate(context.Background(), opts, "@scope/foo@3.0.0")
+	c.Assert(err, qt.ErrorMatches, `failed to fetch @scope/foo@3.0.0: .*version not found`)
+}
+
+func TestValidateErrors(t *testing.T) {
+	c := qt.New(t)
+
+	registry := npmtest.NewRegistry()
+	defer registry.Close()
+	registry.AddVersion("foo", "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+	registry.AddVersion("bad", "1.0.0", map[string]string{"package.json": `{}`, "con.js": "x"}, nil)
+	registry.AddVersion("corrupt", "1.0.0", map[string]string{"package.json": `{}`, "index.js": "x"}, nil)
+	registry.UpdateVersion("corrupt", "1.0.0", func(v map[string]interface{}) {
+		v["dist"].(map[string]interface{})["shasum"] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	})
+
+	opts := Options{Registry: registry.URL, Verification: VerifyStrict}
+	for _, test := range []struct {
+		spec string
+		err  error
+	}{
+		{"missing@1.0.0", ErrPackageNotFound},
+		{"missing", ErrPackageNotFound},
+		{"foo@2.0.0", ErrVersionNotFound},
+		{"bad@1.0.0", ErrInvalidModule},
+		{"corrupt@1.0.0", ErrShasumMismatch},
+	} {
+		_, err := Validate(context.Background(), opts, test.spec)
+		c.Assert(errors.Is(err, test.err), qt.IsTrue, qt.Commentf("%s: %v", test.spec, err))
+	}
+
+	registry.Close()
+	_, err := Validate(context.Background(), opts, "foo@1.0.0")
+	c.Assert(errors.Is(err, ErrRegistryUnavailable), qt.IsTrue)
+	var urlErr *url.Error
+	c.Assert(errors.As(err, &urlErr), qt.IsTrue)
+}
+
+func TestValidateURLPackage(t *testing.T) {
+	c := qt.New(t)
+
+	tarball := npmtest.TarballRoot("mylib-main", map[string]string{
+		"package.json": `{"name": "mylib", "version": "2.0.1"}`,
+		"index.js":     "x",
+	})
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer other.Close()
+	var hits int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mylib.tgz":
+			atomic.AddInt32(&hits, 1)
+			w.Write(tarball)
+		case "/moved.tgz":
+			http.Redirect(w, r, other.URL+"/mylib.tgz", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	// Both test servers use the same certificate.
+	opts := Options{URLHosts: []string{u.Host}, Transport: srv.Client().Transport}
+
+	spec := srv.URL + "/mylib.tgz"
+	result, err := Validate(context.Background(), opts, spec)
+	c.Assert(err, qt.IsNil)
+	c.Assert(result, qt.Equals, ValidateResult{ModulePath: "gohugo.io/npmjs/mylib/v2", Version: "v2.0.1", Files: 2})
+	c.Assert(atomic.LoadInt32(&hits), qt.Equals, int32(1))
+
+	_, err = Validate(context.Background(), Options{Transport: opts.Transport}, spec)
+	c.Assert(err, qt.ErrorMatches, `failed to fetch .*: URL package .* host 127.0.0.1:\d+ is not allowed`)
+
+	_, err = Validate(context.Background(), opts, srv.URL+"/moved.tgz")
+	c.Assert(err, qt.ErrorMatches, `failed to fetch .*: URL package .*: Get .*: host 127.0.0.1:\d+ is not allowed`)
+
+	_, err = Validate(context.Background(), opts, "http://"+u.Host+"/mylib.tgz")
+	c.Assert(err, qt.ErrorMatches, `failed to fetch .*: unsupported URL package .*: only https URLs are supported`)
+
+	_, err = Validate(context.Background(), opts, "git+ssh://git@example.org/foo.git")
+	c.Assert(err, qt.ErrorMatches, `failed to fetch .*: unsupported URL package .*`)
+}
@@ -0,0 +1,163 @@
+package npmgop
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// $base/$module/@v/$version.ziphash
+// Returns the h1: hash of the module zip, as recorded in go.sum files.
+// This is not part of the GOPROXY protocol.
+func (g *npmGoModProxy) ZipHash(w http.ResponseWriter, r *http.Request, mctx moduleContext) {
+	g.logf(r.Context(), "npmgomodproxy.ziphash %s", mctx)
+
+	start := time.Now()
+	npmv, err := g.fetchVersion(r.Context(), &mctx)
+	g.addTiming(w, "fetch", start)
+	if err != nil {
+		g.fail(w, r, "failed to fetch package version", err)
+		return
+	}
+
+	key := g.zipKey(mctx, npmv.Dist.ShaSum)
+	if h, found := g.hashes.get(key); found {
+		fmt.Fprintln(w, h)
+		return
+	}
+	if h, found := g.zips.getHash(mctx); found {
+		g.hashes.put(key, h)
+		fmt.Fprintln(w, h)
+		return
+	}
+
+	var h string
+	if e, found := g.memzips.get(key); found {
+		h, err = hashZip(bytes.NewReader(e.b))
+	} else if f, cleanup, found := g.getStoredZip(r.Context(), mctx, npmv.Dist.ShaSum); found {
+		h, err = hashZip(f)
+		cleanup()
+	} else if f, found := g.zips.get(mctx); found {
+		h, err = hashZip(f)
+		f.Close()
+	} else if r.Method == http.MethodHead {
+		g.headUncachedZip(w, r, mctx, "text/plain; charset=utf-8")
+		return
+	} else {
+		start = time.Now()
+		var f nameReadSeekCloser
+		var cleanup func()
+		f, cleanup, err = g.buildZip(r.Context(), mctx, npmv)
+		g.addTiming(w, "build", start)
+		if err != nil {
+			g.fail(w, r, "failed to create module zip", err)
+			return
+		}
+		h, err = hashZip(f)
+		cleanup()
+	}
+	if err != nil {
+		g.fail(w, r, "failed to hash module zip", err)
+		return
+	}
+
+	g.hashes.put(key, h)
+	if err := g.zips.putHash(mctx, h); err != nil {
+		g.logf(r.Context(), "error: failed to cache module zip hash: %s", err)
+	}
+
+	fmt.Fprintln(w, h)
+}
+
+// hashZip returns the h1: hash of the module zip in r,
+// as dirhash.HashZip does for zip files.
+func hashZip(r io.ReadSeeker) (string, error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return "", errors.New("zip does not support random access")
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	z, err := zip.NewReader(ra, size)
+	if err != nil {
+		return "", err
+	}
+
+	var files []string
+	zfiles := make(map[string]*zip.File)
+	for _, file := range z.File {
+		files = append(files, file.Name)
+		zfiles[file.Name] = file
+	}
+	open := func(name string) (io.ReadCloser, error) {
+		f := zfiles[name]
+		if f == nil {
+			return nil, fmt.Errorf("file %q not found in zip", name)
+		}
+		return f.Open()
+	}
+
+	return dirhash.Hash1(files, open)
+}
+
+// zipHashes caches the h1: hashes of the module zips keyed by zipKey.
+// Entries are content addressed and never invalidated.
+type zipHashes struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func newZipHashes() *zipHashes {
+	return &zipHashes{hashes: make(map[string]string)}
+}
+
+func (h *zipHashes) get(key string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash, found := h.hashes[key]
+	return hash, found
+}
+
+func (h *zipHashes) put(key, hash string) {
+	if key == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hashes[key] = hash
+}
+
+// getHash returns the cached zip hash for mctx, if any.
+func (c *zipCache) getHash(mctx moduleContext) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	b, err := os.ReadFile(c.hashFilename(mctx))
+	if err != nil {
+		return "", false
+	}
+	return string(bytes.TrimSpace(b)), true
+}
+
+// putHash stores the zip hash for mctx next to its zip, as the go command does.
+func (c *zipCache) putHash(mctx moduleContext, hash string) error {
+	if c == nil || !c.contains(mctx) {
+		return nil
+	}
+	return writeFileAtomic(c.hashFilename(mctx), strings.NewReader(hash))
+}
+
+func (c *zipCache) hashFilename(mctx moduleContext) string {
+	return c.filename(mctx) + "hash"
+}